@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/justverena/ATLA/pkg/atla/model"
+	"github.com/justverena/ATLA/pkg/atla/validator"
+)
+
+var (
+	errUsersUsage       = errors.New("usage: atla users create -email <email> -name <name> | list | activate <email> | deactivate <email> | reset-password <email> [flags]")
+	errPermissionsUsage = errors.New("usage: atla permissions list [email] | grant <email> <code>... | revoke <email> <code>... [flags]")
+)
+
+// userPermissions is a user with their permission codes, as printed by the admin commands.
+type userPermissions struct {
+	*model.User
+	Permissions model.Permissions `json:"permissions"`
+}
+
+// usersCommand implements "atla users", which manages user accounts without going through the
+// API, for example to create the first administrator:
+//
+//	create                 create a user, -permissions sets what they may do
+//	list                   print every user with their permissions
+//	activate <email>       activate a user without an activation token
+//	deactivate <email>     deactivate a user and sign them out
+//	reset-password <email> set a new password and sign the user out
+//
+// create and reset-password read the password from the first line of standard input, or
+// generate one with -generate-password and print it.
+func usersCommand(args []string) error {
+	positional, flags := splitArgs(args)
+	if len(positional) == 0 {
+		return errUsersUsage
+	}
+
+	action := positional[0]
+	switch {
+	case (action == "create" || action == "list") && len(positional) == 1:
+	case (action == "activate" || action == "deactivate" || action == "reset-password") && len(positional) == 2:
+	default:
+		return errUsersUsage
+	}
+
+	var name, email, codes string
+	var activated, generate bool
+
+	var commandFlags []func(fs *flag.FlagSet)
+	switch action {
+	case "create":
+		commandFlags = append(commandFlags, func(fs *flag.FlagSet) {
+			fs.StringVar(&name, "name", "", "Name of the user")
+			fs.StringVar(&email, "email", "", "Email address of the user")
+			fs.BoolVar(&activated, "activated", true, "Create the user activated")
+			fs.StringVar(&codes, "permissions", "characters:read", "Comma-separated permission codes to grant")
+		})
+		fallthrough
+	case "reset-password":
+		commandFlags = append(commandFlags, func(fs *flag.FlagSet) {
+			fs.BoolVar(&generate, "generate-password", false, "Generate a random password and print it, instead of reading one from standard input")
+		})
+	}
+
+	cfg, _, err := loadConfig("atla users "+action, flags, os.LookupEnv, commandFlags...)
+	if err != nil {
+		return err
+	}
+
+	// The new user and password are checked before connecting to the database.
+	user := &model.User{Name: name, Email: email, Activated: activated}
+	var password string
+	if action == "create" || action == "reset-password" {
+		password, err = readPassword(generate)
+		if err != nil {
+			return err
+		}
+		if err := user.Password.Set(password); err != nil {
+			return err
+		}
+
+		v := validator.New()
+		if action == "create" {
+			model.ValidateUser(v, user)
+		} else {
+			model.ValidatePasswordPlaintext(v, password)
+		}
+		if !v.Valid() {
+			return fmt.Errorf("invalid user: %s", v.Summary())
+		}
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	models := model.NewModels(tx, cfg.db.timeouts)
+
+	out := envelope{}
+	switch action {
+	case "create":
+		permissions, err := checkPermissions(ctx, models, splitList(codes))
+		if err != nil {
+			return err
+		}
+
+		err = models.Users.Insert(ctx, user)
+		if errors.Is(err, model.ErrDuplicateEmail) {
+			return fmt.Errorf("a user with the email address %q already exists", user.Email)
+		} else if err != nil {
+			return err
+		}
+
+		if len(permissions) > 0 {
+			if err := models.Permissions.AddForUser(ctx, user.ID, permissions...); err != nil {
+				return err
+			}
+		}
+
+		out["user"] = userPermissions{User: user, Permissions: nonNil(permissions)}
+
+	case "list":
+		users, err := models.Users.GetAll(ctx)
+		if err != nil {
+			return err
+		}
+
+		list := make([]userPermissions, 0, len(users))
+		for _, user := range users {
+			permissions, err := models.Permissions.GetAllForUser(ctx, user.ID)
+			if err != nil {
+				return err
+			}
+			list = append(list, userPermissions{User: user, Permissions: nonNil(permissions)})
+		}
+		out["users"] = list
+
+	default:
+		user, err = userByEmail(ctx, models, positional[1])
+		if err != nil {
+			return err
+		}
+
+		switch action {
+		case "activate":
+			user.Activated = true
+		case "deactivate":
+			user.Activated = false
+		case "reset-password":
+			if err := user.Password.Set(password); err != nil {
+				return err
+			}
+		}
+		if err := models.Users.Update(ctx, user); err != nil {
+			return err
+		}
+
+		// Deactivating a user or changing their password ends the sessions they have.
+		if action != "activate" {
+			err := models.Tokens.DeleteAllForUser(ctx, model.ScopeAuthentication, user.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		out["user"] = user
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if generate {
+		out["password"] = password
+	}
+	return printJSON(out)
+}
+
+// permissionsCommand implements "atla permissions", which manages what users may do:
+//
+//	list [email]            print every permission code, or those of a user
+//	grant <email> <code>... give permissions to a user
+//	revoke <email> <code>... take permissions from a user
+func permissionsCommand(args []string) error {
+	positional, flags := splitArgs(args)
+	if len(positional) == 0 {
+		return errPermissionsUsage
+	}
+
+	action := positional[0]
+	switch {
+	case action == "list" && len(positional) <= 2:
+	case (action == "grant" || action == "revoke") && len(positional) >= 3:
+	default:
+		return errPermissionsUsage
+	}
+
+	db, cfg, err := commandDB("atla permissions "+action, flags)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	models := model.NewModels(db, cfg.db.timeouts)
+
+	if action == "list" && len(positional) == 1 {
+		permissions, err := models.Permissions.GetAll(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(envelope{"permissions": nonNil(permissions)})
+	}
+
+	user, err := userByEmail(ctx, models, positional[1])
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "grant", "revoke":
+		codes, err := checkPermissions(ctx, models, positional[2:])
+		if err != nil {
+			return err
+		}
+
+		if action == "grant" {
+			err = models.Permissions.AddForUser(ctx, user.ID, codes...)
+		} else {
+			err = models.Permissions.RemoveForUser(ctx, user.ID, codes...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	permissions, err := models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	return printJSON(envelope{"user": userPermissions{User: user, Permissions: nonNil(permissions)}})
+}
+
+// readPassword returns a random password if generate is set, and the first line of standard
+// input otherwise, so that passwords don't end up in shell histories or process lists.
+func readPassword(generate bool) (string, error) {
+	if generate {
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", errors.New("write the password to standard input, or use -generate-password")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// checkPermissions returns an error if any of codes isn't a known permission.
+func checkPermissions(ctx context.Context, models model.Models, codes []string) ([]string, error) {
+	known, err := models.Permissions.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		if !known.Include(code) {
+			return nil, fmt.Errorf("unknown permission %q, use one of: %s", code, strings.Join(known, ", "))
+		}
+	}
+	return codes, nil
+}
+
+func userByEmail(ctx context.Context, models model.Models, email string) (*model.User, error) {
+	user, err := models.Users.GetByEmail(ctx, email)
+	if errors.Is(err, model.ErrRecordNotFound) {
+		return nil, fmt.Errorf("no user with the email address %q", email)
+	}
+	return user, err
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// nonNil makes an empty list of permissions print as [] rather than null.
+func nonNil(p model.Permissions) model.Permissions {
+	if p == nil {
+		return model.Permissions{}
+	}
+	return p
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/justverena/ATLA/pkg/atla/archive"
+	"github.com/justverena/ATLA/pkg/atla/migrations"
+	"github.com/justverena/ATLA/pkg/atla/validator"
+)
+
+// exportCommand implements "atla export <file>", which writes the whole database to an
+// archive, gzipped when the file name ends in .gz or .tgz.
+func exportCommand(args []string) error {
+	positional, flags := splitArgs(args)
+	if len(positional) != 1 {
+		return errors.New("usage: atla export <file.tar | file.tar.gz> [flags]")
+	}
+	path := positional[0]
+
+	db, _, err := commandDB("atla export", flags)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The archive is written next to its destination and renamed when it is complete, so that
+	// a failed export doesn't leave a truncated archive behind.
+	f, err := os.CreateTemp(filepath.Dir(path), ".atla-export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	compress := strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz")
+	manifest, err := archive.Export(ctx, db, f, compress, printProgress("exported"))
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	return printJSON(envelope{"archive": path, "manifest": manifest})
+}
+
+// importCommand implements "atla import <file>", which restores an archive written by atla
+// export. The import runs in a single transaction, which -dry-run rolls back after counting what
+// would change. A database without a schema is migrated first, in the same transaction, so that
+// a dry run or a failed import leaves it empty.
+func importCommand(args []string) error {
+	positional, flags := splitArgs(args)
+	if len(positional) != 1 {
+		return errors.New("usage: atla import <file.tar | file.tar.gz> [flags]")
+	}
+
+	var policy string
+	var dryRun bool
+
+	cfg, _, err := loadConfig("atla import", flags, os.LookupEnv, func(fs *flag.FlagSet) {
+		fs.StringVar(&policy, "on-conflict", string(archive.PolicyFail), "What to do with rows that differ from existing rows with the same key: "+strings.Join(archive.Policies, ", "))
+		fs.BoolVar(&dryRun, "dry-run", false, "Report what would change without committing it")
+	})
+	if err != nil {
+		return err
+	}
+	if !validator.In(policy, archive.Policies...) {
+		return fmt.Errorf("unknown conflict policy %q, use one of: %s", policy, strings.Join(archive.Policies, ", "))
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	f, err := os.Open(positional[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	m := migrations.New(db)
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var applied []migrations.Step
+	if status.Version == 0 {
+		applied, err = m.UpTx(ctx, tx)
+		if err != nil {
+			return fmt.Errorf("nothing was imported: %w", err)
+		}
+	}
+
+	result, err := archive.Import(ctx, tx, f, archive.Policy(policy), printProgress("imported"))
+	if err != nil {
+		return fmt.Errorf("nothing was imported: %w", err)
+	}
+
+	if !dryRun {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	migrated := make([]int, 0, len(applied))
+	for _, step := range applied {
+		migrated = append(migrated, step.Version)
+	}
+	return printJSON(envelope{"dry_run": dryRun, "migrated": migrated, "result": result})
+}
+
+// printProgress reports the progress of an export or import on standard error, leaving
+// standard output to the JSON result.
+func printProgress(verb string) archive.Progress {
+	return func(table string, done, total int) {
+		if total > 0 {
+			fmt.Fprintf(os.Stderr, "%s %d/%d rows of %s\n", verb, done, total, table)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s %d rows of %s\n", verb, done, table)
+		}
+	}
+}
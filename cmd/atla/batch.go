@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/justverena/ATLA/pkg/atla/validator"
+)
+
+// maxBatchRequests is the maximum number of sub-requests accepted in a single batch.
+const maxBatchRequests = 20
+
+// batchReferenceRX matches references to the result of an earlier sub-request, e.g.
+// "$1.character.id" is the "id" of the "character" in the body of the first response.
+var batchReferenceRX = regexp.MustCompile(`\$([0-9]+)((?:\.[A-Za-z0-9_]+)+)`)
+
+// errBatchDependency is returned when a reference points to a sub-request which failed or to a
+// field its response doesn't have.
+var errBatchDependency = errors.New("unresolved reference")
+
+// errBatchPath is returned when the path of a sub-request, once its references are substituted,
+// isn't a valid URL path.
+var errBatchPath = errors.New("invalid path")
+
+// batchRequest is a single sub-request of a batch. The path is either absolute (/api/v1/...) or
+// relative to the API version of the batch request itself (/characters/1).
+type batchRequest struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Body   interface{} `json:"body,omitempty"`
+}
+
+// batchInput is the request body accepted by batchHandler.
+type batchInput struct {
+	Requests []batchRequest `json:"requests"`
+}
+
+// batchResponse holds the outcome of a single sub-request.
+type batchResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    interface{}       `json:"body"`
+}
+
+// batchHandler runs several sub-requests through the router in process and returns all of their
+// responses at once. The sub-requests run in order with the context of the batch request, so the
+// authenticated user carries over, and each of them can reference the results of earlier ones.
+func (app *application) batchHandler(w http.ResponseWriter, r *http.Request) {
+	var input batchInput
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Requests) > 0, "requests", "must contain at least one request")
+	v.Check(len(input.Requests) <= maxBatchRequests, "requests", fmt.Sprintf("must not contain more than %d requests", maxBatchRequests))
+	for i, sub := range input.Requests {
+		key := fmt.Sprintf("requests.%d", i+1)
+		v.Check(validator.In(sub.Method, "GET", "POST", "PUT", "DELETE"), key+".method", "must be one of GET, POST, PUT or DELETE")
+		v.Check(strings.HasPrefix(sub.Path, "/"), key+".path", "must start with /")
+		v.Check(!strings.HasSuffix(strings.SplitN(sub.Path, "?", 2)[0], "/batch"), key+".path", "must not be a batch request")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	results := make([]interface{}, 0, len(input.Requests))
+	responses := make([]batchResponse, 0, len(input.Requests))
+
+	for _, sub := range input.Requests {
+		res, err := app.dispatchBatchRequest(r, sub, results, responses)
+		switch {
+		case errors.Is(err, errBatchDependency):
+			res = batchResponse{
+				Status: http.StatusFailedDependency,
+				Body:   envelope{"error": err.Error()},
+			}
+		case errors.Is(err, errBatchPath):
+			res = batchResponse{
+				Status: http.StatusBadRequest,
+				Body:   envelope{"error": err.Error()},
+			}
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		responses = append(responses, res)
+		results = append(results, res.Body)
+	}
+
+	err = app.render(w, r, http.StatusOK, envelope{"responses": responses}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// dispatchBatchRequest resolves the references of a sub-request and serves it with the router.
+func (app *application) dispatchBatchRequest(r *http.Request, sub batchRequest, results []interface{},
+	responses []batchResponse) (batchResponse, error) {
+	resolve := func(ref string, index int, fields string) (interface{}, error) {
+		if index < 1 || index > len(results) {
+			return nil, fmt.Errorf("%w %s: there is no earlier request %d", errBatchDependency, ref, index)
+		}
+		if status := responses[index-1].Status; status >= 300 {
+			return nil, fmt.Errorf("%w %s: request %d failed with status %d", errBatchDependency, ref, index, status)
+		}
+
+		value := results[index-1]
+		for _, field := range strings.Split(strings.TrimPrefix(fields, "."), ".") {
+			value = lookupField(value, field)
+			if value == nil {
+				return nil, fmt.Errorf("%w %s: response %d has no field %q", errBatchDependency, ref, index, field)
+			}
+		}
+		return value, nil
+	}
+
+	path, err := substituteReferences(sub.Path, resolve)
+	if err != nil {
+		return batchResponse{}, err
+	}
+
+	body, err := substituteBody(sub.Body, resolve)
+	if err != nil {
+		return batchResponse{}, err
+	}
+
+	target := scalarString(path)
+	if !strings.HasPrefix(target, "/api/") {
+		target = app.apiPrefix(r) + target
+	}
+
+	var reader *bytes.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return batchResponse{}, err
+		}
+		reader = bytes.NewReader(js)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	// The sub-request inherits the context of the batch, and with it the authenticated user.
+	// Its response is always JSON, so that it can be embedded in the batch response whatever
+	// representation the client asked for.
+	ctx := context.WithValue(r.Context(), formatContextKey, formats[0])
+	req, err := http.NewRequestWithContext(ctx, sub.Method, target, reader)
+	if err != nil {
+		return batchResponse{}, fmt.Errorf("%w %q", errBatchPath, target)
+	}
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.RemoteAddr = r.RemoteAddr
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		req.Header.Set("X-Forwarded-For", xff)
+	}
+
+	// Every sub-request is charged to the per-IP and per-user limits like a request of its own,
+	// so that a batch doesn't buy 20 requests for the price of one.
+	rec := newBatchRecorder()
+	app.rateLimitIP(groupDefault, app.rateLimitUser(app.versioned(app.router))).ServeHTTP(rec, req)
+
+	res := batchResponse{
+		Status:  rec.status,
+		Headers: make(map[string]string),
+	}
+	for k := range rec.header {
+		res.Headers[k] = rec.header.Get(k)
+	}
+
+	// Decode numbers as json.Number so that IDs are substituted into later paths verbatim.
+	dec := json.NewDecoder(bytes.NewReader(rec.body.Bytes()))
+	dec.UseNumber()
+
+	var decoded interface{}
+	if err := dec.Decode(&decoded); err != nil {
+		res.Body = rec.body.String()
+	} else {
+		res.Body = decoded
+	}
+
+	return res, nil
+}
+
+// substituteReferences replaces the references in s. A string which is exactly one reference is
+// replaced with the referenced value itself, so that numbers stay numbers in request bodies.
+func substituteReferences(s string, resolve func(string, int, string) (interface{}, error)) (interface{}, error) {
+	if m := batchReferenceRX.FindStringSubmatch(s); m != nil && m[0] == s {
+		index, _ := strconv.Atoi(m[1])
+		return resolve(m[0], index, m[2])
+	}
+
+	var firstErr error
+	out := batchReferenceRX.ReplaceAllStringFunc(s, func(ref string) string {
+		m := batchReferenceRX.FindStringSubmatch(ref)
+		index, _ := strconv.Atoi(m[1])
+
+		value, err := resolve(ref, index, m[2])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return ref
+		}
+		return scalarString(value)
+	})
+
+	return out, firstErr
+}
+
+// substituteBody walks a decoded JSON body and substitutes the references in its strings.
+func substituteBody(v interface{}, resolve func(string, int, string) (interface{}, error)) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return substituteReferences(v, resolve)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			value, err := substituteBody(item, resolve)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = value
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			value, err := substituteBody(item, resolve)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = value
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+// lookupField returns a member of a decoded JSON object, or an element of an array when field
+// is an index. It returns nil if there is no such member.
+func lookupField(v interface{}, field string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v[field]
+	case []interface{}:
+		i, err := strconv.Atoi(field)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil
+		}
+		return v[i]
+	default:
+		return nil
+	}
+}
+
+// batchRecorder is the http.ResponseWriter a sub-request is served with.
+type batchRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+	status int
+}
+
+func newBatchRecorder() *batchRecorder {
+	return &batchRecorder{header: make(http.Header)}
+}
+
+func (rec *batchRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *batchRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *batchRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
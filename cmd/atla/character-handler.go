@@ -13,17 +13,31 @@ import (
 	"github.com/justverena/ATLA/pkg/atla/validator"
 )
 
+// createCharacterInput is the request body accepted by createCharacterHandler.
+type createCharacterInput struct {
+	ID     int    `json:"id,omitempty"`
+	Name   string `json:"name"`
+	Age    int    `json:"age"`
+	Gender string `json:"gender"`
+	Status string `json:"status"`
+	Nation string `json:"nation"`
+	// CreatedAt string `json:"createdAt"`
+	// UpdatedAt string `json:"updatedAt"`
+}
+
+// updateCharacterInput is the request body accepted by updateCharacterHandler. Every field is
+// a pointer so that we can tell the fields that were omitted from the ones set to a zero value.
+type updateCharacterInput struct {
+	ID     *int    `json:"id"`
+	Name   *string `json:"name"`
+	Age    *int    `json:"age"`
+	Gender *string `json:"gender"`
+	Status *string `json:"status"`
+	Nation *string `json:"nation"`
+}
+
 func (app *application) createCharacterHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		ID     int    `json:"id"`
-		Name   string `json:"name"`
-		Age    int    `json:"age"`
-		Gender string `json:"gender"`
-		Status string `json:"status"`
-		Nation string `json:"nation"`
-		// CreatedAt string `json:"createdAt"`
-		// UpdatedAt string `json:"updatedAt"`
-	}
+	var input createCharacterInput
 
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -43,13 +57,13 @@ func (app *application) createCharacterHandler(w http.ResponseWriter, r *http.Re
 		// UpdatedAt: input.UpdatedAt,
 	}
 
-	err = app.models.Characters.Insert(character)
+	err = app.models.Characters.Insert(r.Context(), character)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusCreated, envelope{"character": character}, nil)
+	app.render(w, r, http.StatusCreated, envelope{"character": app.characterResource(r, character)}, nil)
 }
 
 func (app *application) getCharacterList(w http.ResponseWriter, r *http.Request) {
@@ -78,13 +92,18 @@ func (app *application) getCharacterList(w http.ResponseWriter, r *http.Request)
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	characters, metadata, err := app.models.Characters.GetAll(input.Name, input.Age, input.Age, input.Filters)
+	characters, metadata, err := app.models.Characters.GetAll(r.Context(), input.Name, input.Age, input.Age, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"characters": characters, "metadata": metadata}, nil)
+	fingerprint := listFingerprint(characters, (*model.Character).Stamp)
+	if app.listNotModified(w, r, fingerprint, metadata.TotalRecords) {
+		return
+	}
+
+	app.render(w, r, http.StatusOK, envelope{"characters": app.characterResources(r, characters), "metadata": app.listMetadata(r, "/characters", metadata)}, nil)
 }
 
 func (app *application) getCharacterHandler(w http.ResponseWriter, r *http.Request) {
@@ -94,7 +113,7 @@ func (app *application) getCharacterHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	character, err := app.models.Characters.Get(id)
+	character, err := app.models.Characters.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -105,7 +124,11 @@ func (app *application) getCharacterHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"character": character}, nil)
+	if app.notModified(w, r, character.UpdatedAt, character.ID) {
+		return
+	}
+
+	app.render(w, r, http.StatusOK, envelope{"character": app.characterResource(r, character)}, nil)
 }
 
 func (app *application) updateCharacterHandler(w http.ResponseWriter, r *http.Request) {
@@ -115,7 +138,7 @@ func (app *application) updateCharacterHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	character, err := app.models.Characters.Get(id)
+	character, err := app.models.Characters.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -126,14 +149,7 @@ func (app *application) updateCharacterHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	var input struct {
-		ID     *int    `json:"id"`
-		Name   *string `json:"name"`
-		Age    *int    `json:"age"`
-		Gender *string `json:"gender"`
-		Status *string `json:"status"`
-		Nation *string `json:"nation"`
-	}
+	var input updateCharacterInput
 
 	err = app.readJSON(w, r, &input)
 	if err != nil {
@@ -163,7 +179,7 @@ func (app *application) updateCharacterHandler(w http.ResponseWriter, r *http.Re
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	err = app.models.Characters.Update(character)
+	err = app.models.Characters.Update(r.Context(), character)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -174,7 +190,7 @@ func (app *application) updateCharacterHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"character": character}, nil)
+	app.render(w, r, http.StatusOK, envelope{"character": app.characterResource(r, character)}, nil)
 }
 
 func (app *application) deleteCharacterHandler(w http.ResponseWriter, r *http.Request) {
@@ -184,7 +200,7 @@ func (app *application) deleteCharacterHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	err = app.models.Characters.Delete(id)
+	err = app.models.Characters.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -195,7 +211,7 @@ func (app *application) deleteCharacterHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"message": "success"}, nil)
+	app.render(w, r, http.StatusOK, envelope{"message": "success"}, nil)
 }
 
 func (app *application) getEpisodeCharacters(w http.ResponseWriter, r *http.Request) {
@@ -206,21 +222,24 @@ func (app *application) getEpisodeCharacters(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	episode, err := app.models.Episodes.Get(episodeID)
+	episode, err := app.models.Episodes.Get(r.Context(), episodeID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	characters, err := app.models.Characters.GetByEpisode(episodeID)
+	characters, err := app.models.Characters.GetByEpisode(r.Context(), episodeID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"episode": episode}, nil)
+	fingerprint := listFingerprint(characters, (*model.Character).Stamp)
+	if app.listNotModified(w, r, episode.ID, episode.UpdatedAt.Unix(), fingerprint) {
+		return
+	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"characters": characters}, nil)
+	app.render(w, r, http.StatusOK, envelope{"episode": app.episodeResource(r, episode), "characters": app.characterResources(r, characters)}, nil)
 }
 
 func (app *application) getQuoteCharacter(w http.ResponseWriter, r *http.Request) {
@@ -231,19 +250,21 @@ func (app *application) getQuoteCharacter(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	quote, err := app.models.Quotes.Get(quoteID)
+	quote, err := app.models.Quotes.Get(r.Context(), quoteID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	character, err := app.models.Characters.GetByQuote(quoteID)
+	character, err := app.models.Characters.GetByQuote(r.Context(), quoteID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"quote": quote}, nil)
+	if app.notModified(w, r, latest(quote.UpdatedAt, character.UpdatedAt), quote.ID, character.ID) {
+		return
+	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"character": character}, nil)
+	app.render(w, r, http.StatusOK, envelope{"quote": app.quoteResource(r, quote), "character": app.characterResource(r, character)}, nil)
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// commands are the administrative subcommands, run as "atla <command> [arguments] [flags]".
+// Without a command, atla serves the API.
+var commands = map[string]func(args []string) error{
+	"config":      configCommand,
+	"export":      exportCommand,
+	"import":      importCommand,
+	"migrate":     migrateCommand,
+	"permissions": permissionsCommand,
+	"seed":        seedCommand,
+	"users":       usersCommand,
+}
+
+// runCommand runs the command named by args[0] and exits with status 1 if it fails.
+func runCommand(args []string) {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(os.Stderr, "atla: unknown command %q (commands: %s)\n", args[0], strings.Join(names, ", "))
+		os.Exit(2)
+	}
+
+	err := cmd(args[1:])
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "atla %s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+// printJSON writes data to standard output as indented JSON, the output format of all commands.
+func printJSON(data interface{}) error {
+	js, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+
+	_, err = os.Stdout.Write(js)
+	return err
+}
+
+// splitArgs splits the arguments of a command into the leading positional arguments and the
+// flags that follow them.
+func splitArgs(args []string) (positional, flags []string) {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			return args[:i], args[i:]
+		}
+	}
+	return args, nil
+}
+
+// commandDB loads the configuration of a command, from the flags in args, the environment and
+// the configuration file, and connects to the database. commandFlags are passed to loadConfig.
+func commandDB(name string, args []string, commandFlags ...func(fs *flag.FlagSet)) (*sql.DB, config, error) {
+	cfg, _, err := loadConfig(name, args, os.LookupEnv, commandFlags...)
+	if err != nil {
+		return nil, cfg, err
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		return nil, cfg, err
+	}
+	return db, cfg, nil
+}
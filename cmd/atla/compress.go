@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressor is implemented by *gzip.Writer and *flate.Writer.
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// encodings are the content codings we can produce, in order of preference when the client
+// accepts several of them with the same quality.
+var encodings = []struct {
+	name string
+	pool *sync.Pool
+}{
+	{"gzip", &sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+		return w
+	}}},
+	{"deflate", &sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(io.Discard, flate.DefaultCompression)
+		return w
+	}}},
+}
+
+// compressedTypes are media types that are compressed already, so compressing them again only
+// costs CPU. Type prefixes end with a slash.
+var compressedTypes = []string{
+	"image/", "video/", "audio/", "font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-tar", "application/octet-stream",
+}
+
+// compress compresses response bodies with gzip or deflate, whichever the client prefers in
+// Accept-Encoding. Bodies smaller than -compress-min-size aren't worth the overhead and are sent
+// as they are, and so are media types that are compressed already.
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Whether the response is compressed depends on Accept-Encoding, so caches must not
+		// hand a gzipped response to a client that can't decode it.
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding < 0 || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			minSize:        app.config.compress.minSize,
+		}
+		next.ServeHTTP(cw, r)
+		cw.close()
+	})
+}
+
+// negotiateEncoding returns the index in encodings of the coding to use for the Accept-Encoding
+// header value, or -1 if the response must not be compressed.
+func negotiateEncoding(header string) int {
+	qualities := make(map[string]float64)
+
+	for _, part := range strings.Split(header, ",") {
+		name, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		qualities[name] = q
+	}
+
+	best, bestQ := -1, 0.0
+	for i, e := range encodings {
+		// A coding that is listed by name takes precedence over "*", which also lets clients
+		// refuse a coding with q=0.
+		q, ok := qualities[e.name]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+
+	return best
+}
+
+// compressWriter buffers the start of the response body until it knows whether compressing it
+// is worthwhile, then either streams the rest through a pooled compressor or writes it as is.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding int
+	minSize  int
+
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	cw      compressor
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if w.decided {
+		if w.cw != nil {
+			return w.cw.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buf.Write(b)
+	if w.buf.Len() >= w.minSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start sends the response header, compressing the body if allowed and worthwhile, and flushes
+// the buffered start of the body.
+func (w *compressWriter) start(large bool) error {
+	w.decided = true
+
+	if large && w.compressible() {
+		h := w.Header()
+		h.Set("Content-Encoding", encodings[w.encoding].name)
+		h.Del("Content-Length")
+
+		// The compressed representation has different bytes, so a strong validator of the
+		// uncompressed body no longer applies.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+
+		w.cw = encodings[w.encoding].pool.Get().(compressor)
+		w.cw.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.cw != nil {
+		_, err = w.cw.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
+
+// compressible reports whether the response may be compressed, judging from its status and
+// headers.
+func (w *compressWriter) compressible() bool {
+	h := w.Header()
+
+	if w.status < 200 || w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	contentType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if contentType == "image/svg+xml" {
+		return true
+	}
+	for _, t := range compressedTypes {
+		if contentType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t)) {
+			return false
+		}
+	}
+	return true
+}
+
+// close writes whatever is still buffered and returns the compressor to its pool.
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.status == 0 {
+			// The handler didn't write anything, leave the default 200 to net/http.
+			return
+		}
+		w.start(false)
+	}
+
+	if w.cw != nil {
+		w.cw.Close()
+		w.cw.Reset(io.Discard)
+		encodings[w.encoding].pool.Put(w.cw)
+		w.cw = nil
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying http.ResponseWriter.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
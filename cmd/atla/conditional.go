@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Cache policies that routes can refer to with their cache field. The Cache-Control header sent
+// for each of them is configured with the -cache-control-* flags.
+const (
+	cacheReads  = "reads"
+	cacheStatic = "static"
+)
+
+// cacheControl sets the Cache-Control header configured for policy on successful responses, so
+// that shared caches such as a CDN can serve public reads. errorResponse overrides it for errors.
+func (app *application) cacheControl(policy string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if value := app.config.cache.policies[policy]; value != "" {
+			w.Header().Set("Cache-Control", value)
+		}
+		next(w, r)
+	}
+}
+
+// notModified handles a conditional GET. It sets the ETag and Last-Modified validators of the
+// response and, if the client's copy is still fresh according to If-None-Match or
+// If-Modified-Since, sends 304 Not Modified and returns true. The handler must not write anything
+// else in that case.
+//
+// lastModified is the updated_at of the resource. The ETag is derived from it, the parts (ids,
+// list fingerprints...), and everything else that changes the representation: path, query
+// string, response format and API version.
+func (app *application) notModified(w http.ResponseWriter, r *http.Request, lastModified time.Time, parts ...interface{}) bool {
+	lastModified = lastModified.UTC().Truncate(time.Second)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%d\n", r.URL.Path, r.URL.Query().Encode(), app.contextGetFormat(r).name,
+		app.contextGetVersion(r), lastModified.Unix())
+	for _, part := range parts {
+		fmt.Fprintf(h, "%v\n", part)
+	}
+	etag := `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	fresh := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// If-None-Match takes precedence over If-Modified-Since, and uses the weak comparison.
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				fresh = true
+				break
+			}
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ims)
+		fresh = err == nil && !lastModified.After(since)
+	}
+
+	if fresh {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return fresh
+}
+
+// listNotModified is notModified for lists and relationships, which are validated by their ETag
+// alone. Deleting, linking or unlinking items doesn't move any updated_at, so a Last-Modified date
+// taken from the items would let If-Modified-Since answer 304 with a stale list.
+func (app *application) listNotModified(w http.ResponseWriter, r *http.Request, parts ...interface{}) bool {
+	return app.notModified(w, r, time.Time{}, parts...)
+}
+
+// listFingerprint returns a fingerprint of the ids and update times of the items of a list, which
+// changes when items are added, removed, reordered or updated.
+func listFingerprint[T any](items []T, stamp func(T) (int, time.Time)) string {
+	var b strings.Builder
+
+	for _, item := range items {
+		id, updatedAt := stamp(item)
+		fmt.Fprintf(&b, "%d@%d;", id, updatedAt.Unix())
+	}
+
+	return b.String()
+}
+
+// latest returns the latest of the given times.
+func latest(times ...time.Time) time.Time {
+	var t time.Time
+	for _, candidate := range times {
+		if candidate.After(t) {
+			t = candidate
+		}
+	}
+	return t
+}
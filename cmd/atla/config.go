@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/justverena/ATLA/pkg/atla/model"
+	"github.com/justverena/ATLA/pkg/atla/schedule"
+	"github.com/justverena/ATLA/pkg/atla/validator"
+	"github.com/justverena/ATLA/pkg/jsonlog"
+)
+
+// envPrefix is the prefix of the environment variables that configure atla. The variable of a
+// flag is its name in upper case with underscores, e.g. ATLA_DB_DSN for -db-dsn.
+const envPrefix = "ATLA_"
+
+// Where the value of a setting came from, in increasing order of precedence.
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// secretSettings are the settings whose values are redacted, with the given function, when the
+// configuration is printed.
+var secretSettings = map[string]func(string) string{"db-dsn": redactDSN}
+
+// setting is the effective value of a flag and where it came from.
+type setting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// configErrors holds every problem found in the configuration, by setting.
+type configErrors map[string]string
+
+func (e configErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("invalid configuration:")
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n  %s: %s", name, e[name])
+	}
+	return b.String()
+}
+
+// rawConfig holds the flag values that are parsed into config after all the layers are applied.
+type rawConfig struct {
+	dsnFile             string
+	logLevel            string
+	v1Deprecation       string
+	v1Sunset            string
+	defaultLimit        limit
+	authLimit           limit
+	userLimit           limit
+	trustedProxies      string
+	trustedOrigins      string
+	cacheReads          string
+	cacheStatic         string
+	purgeTokensSchedule string
+	purgeUsersSchedule  string
+}
+
+// registerFlags defines every setting as a flag of fs. The configuration file and the environment
+// can only set what is defined here.
+func registerFlags(fs *flag.FlagSet, cfg *config, raw *rawConfig) {
+	fs.IntVar(&cfg.port, "port", 8081, "API server port")
+	fs.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	fs.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
+	fs.StringVar(&raw.dsnFile, "db-dsn-file", "", "File to read the PostgreSQL DSN from, instead of -db-dsn")
+	fs.BoolVar(&cfg.migrateOnStart, "migrate-on-start", false, "Apply pending database migrations before starting the server")
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL maximum open connections (0 for no limit)")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL maximum idle connections")
+	fs.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "PostgreSQL maximum connection idle time")
+	fs.DurationVar(&cfg.db.timeouts.Read, "db-read-timeout", model.DefaultTimeouts.Read, "Longest time a query reading a single record may take")
+	fs.DurationVar(&cfg.db.timeouts.List, "db-list-timeout", model.DefaultTimeouts.List, "Longest time a query reading a list may take")
+	fs.DurationVar(&cfg.db.timeouts.Write, "db-write-timeout", model.DefaultTimeouts.Write, "Longest time an insert, update or delete may take")
+	fs.StringVar(&cfg.baseURL, "base-url", "", "Public base URL when served behind a reverse proxy (e.g. https://example.com/atla)")
+	fs.BoolVar(&cfg.openapi.validate, "openapi-validate", false, "Reject requests that don't match the OpenAPI specification")
+	fs.StringVar(&raw.logLevel, "log-level", "info", "Lowest level of the log entries that are written (info|error|fatal|off)")
+
+	fs.DurationVar(&cfg.shutdown.delay, "shutdown-delay", 0, "How long to keep serving, with /readyz failing, after a shutdown signal before draining")
+	fs.DurationVar(&cfg.shutdown.timeout, "shutdown-timeout", 20*time.Second, "Longest time to wait for requests in flight to finish when shutting down")
+	fs.DurationVar(&cfg.shutdown.tasksTimeout, "shutdown-tasks-timeout", longestJobTimeout(), "Longest time to wait for background tasks to finish when shutting down, at least the longest job timeout")
+
+	fs.IntVar(&cfg.jobs.workers, "jobs-workers", 2, "Number of background jobs run at the same time (0 to run none in this instance)")
+	fs.DurationVar(&cfg.jobs.pollInterval, "jobs-poll-interval", time.Second, "How often idle job workers look for runnable jobs")
+	fs.StringVar(&raw.purgeTokensSchedule, "schedule-"+jobPurgeTokens, "@hourly", "Cron schedule (UTC) of the purge of expired tokens, empty to disable it")
+	fs.StringVar(&raw.purgeUsersSchedule, "schedule-"+jobPurgeUsers, "@daily", "Cron schedule (UTC) of the purge of unactivated users, empty to disable it")
+	fs.DurationVar(&cfg.jobs.leaderCheckInterval, "leader-check-interval", 5*time.Second, "How often followers try to become the leader, and the leader checks its database connection")
+	fs.IntVar(&cfg.jobs.unactivatedUsersDays, "purge-unactivated-users-days", 30, "Days after registering that users who haven't activated their account are deleted")
+
+	fs.StringVar(&raw.v1Deprecation, "v1-deprecation", "2026-10-01", "Date (YYYY-MM-DD) /api/v1 was deprecated, sent in the Deprecation header")
+	fs.StringVar(&raw.v1Sunset, "v1-sunset", "2027-04-01", "Date (YYYY-MM-DD) /api/v1 will be removed, sent in the Sunset header")
+
+	fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	fs.Float64Var(&raw.defaultLimit.rps, "limiter-rps", 4, "Rate limiter maximum requests per second, per IP")
+	fs.IntVar(&raw.defaultLimit.burst, "limiter-burst", 8, "Rate limiter maximum burst, per IP")
+	fs.Float64Var(&raw.authLimit.rps, "limiter-auth-rps", 0.2, "Rate limiter maximum requests per second for login and registration, per IP")
+	fs.IntVar(&raw.authLimit.burst, "limiter-auth-burst", 5, "Rate limiter maximum burst for login and registration, per IP")
+	fs.Float64Var(&raw.userLimit.rps, "limiter-user-rps", 10, "Rate limiter maximum requests per second, per authenticated user")
+	fs.IntVar(&raw.userLimit.burst, "limiter-user-burst", 20, "Rate limiter maximum burst, per authenticated user")
+	fs.StringVar(&raw.trustedProxies, "limiter-trusted-proxies", "", "Comma-separated IPs or CIDRs of proxies whose X-Forwarded-For header is trusted")
+
+	fs.StringVar(&raw.trustedOrigins, "cors-trusted-origins", "", "Trusted CORS origins (separated by spaces or commas)")
+	fs.BoolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", false, "Allow credentialed CORS requests from trusted origins")
+	fs.DurationVar(&cfg.cors.maxAge, "cors-max-age", 10*time.Minute, "How long browsers may cache CORS preflight responses")
+	fs.StringVar(&cfg.metrics.addr, "metrics-addr", "", "Serve /debug/metrics on this separate admin address (e.g. localhost:9090) instead of the API port")
+	fs.IntVar(&cfg.compress.minSize, "compress-min-size", 1024, "Smallest response body, in bytes, that is compressed")
+	fs.BoolVar(&cfg.modelCache.enabled, "model-cache-enabled", false, "Cache character, episode and quote reads in memory")
+	fs.IntVar(&cfg.modelCache.size, "model-cache-size", 1000, "Maximum number of entries in the model cache")
+	fs.DurationVar(&cfg.modelCache.ttl, "model-cache-ttl", 30*time.Second, "How long model cache entries are kept")
+
+	fs.StringVar(&cfg.tls.certFile, "tls-cert", "", "TLS certificate file (PEM); serve HTTPS when set together with -tls-key")
+	fs.StringVar(&cfg.tls.keyFile, "tls-key", "", "TLS private key file (PEM)")
+	fs.BoolVar(&cfg.tls.dev, "tls-dev", false, "Serve HTTPS with a generated self-signed certificate for localhost")
+	fs.StringVar(&cfg.tls.devDir, "tls-dev-dir", "", "Directory the -tls-dev certificate is cached in (default: the user cache directory)")
+	fs.StringVar(&cfg.tls.redirectAddr, "tls-redirect-addr", "", "Plaintext address (e.g. :8080) that redirects to HTTPS")
+
+	fs.StringVar(&raw.cacheReads, "cache-control-reads", "public, max-age=60", "Cache-Control header of character, episode and quote reads")
+	fs.StringVar(&raw.cacheStatic, "cache-control-static", "public, max-age=3600", "Cache-Control header of static documents such as the OpenAPI description")
+}
+
+// loadConfig builds the configuration in layers: the flag defaults, then the -config file (YAML
+// or TOML), then ATLA_* environment variables, then the flags in args. It returns the effective
+// value of every setting along with the configuration. Every problem found is reported at once,
+// in a configErrors.
+//
+// Commands can define flags of their own with commandFlags. Those are only read from args.
+func loadConfig(name string, args []string, lookupEnv func(string) (string, bool), commandFlags ...func(fs *flag.FlagSet)) (config, []setting, error) {
+	var cfg config
+	var raw rawConfig
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String("config", "", "Configuration file (.yaml, .yml or .toml) holding "+configFileSubset)
+	registerFlags(fs, &cfg, &raw)
+
+	// sources has an entry for every setting, which tells them apart from command flags.
+	sources := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) { sources[f.Name] = sourceDefault })
+
+	for _, register := range commandFlags {
+		register(fs)
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return cfg, nil, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if _, ok := sources[f.Name]; ok {
+			sources[f.Name] = sourceFlag
+		}
+	})
+
+	v := validator.New()
+
+	// set applies a value from the configuration file or the environment, unless the setting was
+	// given as a flag.
+	set := func(name, value, source, origin string) {
+		if sources[name] == sourceFlag {
+			return
+		}
+		if err := fs.Set(name, value); err != nil {
+			v.AddError(name, fmt.Sprintf("invalid value %q in %s: %v", value, origin, err))
+			return
+		}
+		sources[name] = source
+	}
+
+	if value, ok := lookupEnv(envName("config")); ok {
+		set("config", value, sourceEnv, envName("config"))
+	}
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			v.AddError("config", err.Error())
+		}
+
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if _, ok := sources[key]; !ok || key == "config" {
+				v.AddError(key, fmt.Sprintf("unknown setting in %s", *configFile))
+				continue
+			}
+			set(key, values[key], sourceFile, *configFile)
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := sources[f.Name]; !ok || f.Name == "config" {
+			return
+		}
+		if value, ok := lookupEnv(envName(f.Name)); ok {
+			set(f.Name, value, sourceEnv, envName(f.Name))
+		}
+	})
+
+	// Secrets are better kept out of the file, the environment and the command line, which are
+	// easy to leak, so the DSN can be read from a file such as a Docker or Kubernetes secret.
+	if raw.dsnFile != "" {
+		if sources["db-dsn"] != sourceDefault {
+			v.AddError("db-dsn-file", "can't be combined with db-dsn")
+		} else if data, err := os.ReadFile(raw.dsnFile); err != nil {
+			v.AddError("db-dsn-file", err.Error())
+		} else {
+			cfg.db.dsn = strings.TrimSpace(string(data))
+			sources["db-dsn"] = sources["db-dsn-file"]
+		}
+	}
+
+	validateConfig(v, &cfg, &raw)
+
+	var settings []setting
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := sources[f.Name]; !ok {
+			return
+		}
+		value := f.Value.String()
+		if f.Name == "db-dsn" {
+			value = cfg.db.dsn
+		}
+		settings = append(settings, setting{Name: f.Name, Value: value, Source: sources[f.Name]})
+	})
+
+	if !v.Valid() {
+		return cfg, settings, configErrors(v.Errors)
+	}
+	return cfg, settings, nil
+}
+
+// validateConfig checks the settings and fills in the parts of cfg that are parsed from raw.
+func validateConfig(v *validator.Validator, cfg *config, raw *rawConfig) {
+	v.Check(cfg.port > 0 && cfg.port <= 65535, "port", "must be between 1 and 65535")
+	v.Check(validator.In(cfg.env, "development", "staging", "production"), "env", "must be development, staging or production")
+	v.Check(cfg.db.dsn != "", "db-dsn", "must be set, with db-dsn or db-dsn-file")
+	v.Check(cfg.db.maxOpenConns >= 0, "db-max-open-conns", "must not be negative")
+	v.Check(cfg.db.maxIdleConns >= 0, "db-max-idle-conns", "must not be negative")
+	v.Check(cfg.db.maxOpenConns == 0 || cfg.db.maxIdleConns <= cfg.db.maxOpenConns, "db-max-idle-conns", "must not be more than db-max-open-conns")
+	v.Check(cfg.db.maxIdleTime >= 0, "db-max-idle-time", "must not be negative")
+	v.Check(cfg.db.timeouts.Read > 0, "db-read-timeout", "must be positive")
+	v.Check(cfg.db.timeouts.List > 0, "db-list-timeout", "must be positive")
+	v.Check(cfg.db.timeouts.Write > 0, "db-write-timeout", "must be positive")
+
+	cfg.baseURL = strings.TrimSuffix(cfg.baseURL, "/")
+	if cfg.baseURL != "" {
+		u, err := url.Parse(cfg.baseURL)
+		v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "base-url", "must be an absolute http or https URL")
+	}
+
+	var err error
+	if cfg.logLevel, err = jsonlog.ParseLevel(raw.logLevel); err != nil {
+		v.AddError("log-level", "must be info, error, fatal or off")
+	}
+	v.Check(cfg.shutdown.delay >= 0, "shutdown-delay", "must not be negative")
+	v.Check(cfg.shutdown.timeout > 0, "shutdown-timeout", "must be positive")
+	v.Check(cfg.shutdown.tasksTimeout > 0, "shutdown-tasks-timeout", "must be positive")
+	// Jobs aren't cancelled by a shutdown, so the server waits for them to finish.
+	v.Check(cfg.jobs.workers == 0 || cfg.shutdown.tasksTimeout >= longestJobTimeout(), "shutdown-tasks-timeout",
+		fmt.Sprintf("must be at least the longest job timeout, %s, unless jobs-workers is 0", longestJobTimeout()))
+	v.Check(cfg.jobs.workers >= 0, "jobs-workers", "must not be negative")
+	v.Check(cfg.jobs.pollInterval > 0, "jobs-poll-interval", "must be positive")
+	v.Check(cfg.jobs.leaderCheckInterval > 0, "leader-check-interval", "must be positive")
+	v.Check(cfg.jobs.unactivatedUsersDays >= 1, "purge-unactivated-users-days", "must be at least 1")
+
+	cfg.jobs.schedules = make(map[string]schedule.Cron)
+	for kind, spec := range map[string]string{jobPurgeTokens: raw.purgeTokensSchedule, jobPurgeUsers: raw.purgeUsersSchedule} {
+		if spec == "" {
+			continue
+		}
+		c, err := schedule.Parse(spec)
+		if err != nil {
+			v.AddError("schedule-"+kind, err.Error())
+			continue
+		}
+		cfg.jobs.schedules[kind] = c
+	}
+
+	if cfg.v1.deprecation, err = parseDate(raw.v1Deprecation); err != nil {
+		v.AddError("v1-deprecation", "must be a date in the YYYY-MM-DD format")
+	}
+	if cfg.v1.sunset, err = parseDate(raw.v1Sunset); err != nil {
+		v.AddError("v1-sunset", "must be a date in the YYYY-MM-DD format")
+	}
+
+	cfg.limiter.groups = map[string]limit{
+		groupDefault: raw.defaultLimit,
+		groupAuth:    raw.authLimit,
+		groupUser:    raw.userLimit,
+	}
+	for prefix, l := range map[string]limit{"limiter": raw.defaultLimit, "limiter-auth": raw.authLimit, "limiter-user": raw.userLimit} {
+		v.Check(l.rps > 0, prefix+"-rps", "must be positive")
+		v.Check(l.burst >= 1, prefix+"-burst", "must be at least 1")
+	}
+	if cfg.limiter.trustedProxies, err = parseTrustedProxies(raw.trustedProxies); err != nil {
+		v.AddError("limiter-trusted-proxies", err.Error())
+	}
+
+	cfg.cors.trustedOrigins = strings.FieldsFunc(raw.trustedOrigins, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	v.Check(cfg.cors.maxAge >= 0, "cors-max-age", "must not be negative")
+	// Browsers refuse credentials with Access-Control-Allow-Origin: *, and echoing every origin
+	// instead would let any site make authenticated requests.
+	v.Check(!cfg.cors.allowCredentials || !validator.In("*", cfg.cors.trustedOrigins...), "cors-allow-credentials", "must not be set when cors-trusted-origins is *")
+	v.Check(cfg.compress.minSize >= 0, "compress-min-size", "must not be negative")
+
+	cfg.cache.policies = map[string]string{
+		cacheReads:  raw.cacheReads,
+		cacheStatic: raw.cacheStatic,
+	}
+
+	if cfg.modelCache.enabled {
+		v.Check(cfg.modelCache.size >= 1, "model-cache-size", "must be at least 1")
+		v.Check(cfg.modelCache.ttl > 0, "model-cache-ttl", "must be positive")
+	}
+
+	validateTLSConfig(v, cfg.tls)
+}
+
+// envName returns the environment variable of a flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// dsnPasswordRX matches the password of a key/value DSN, or of a URL DSN given as a parameter.
+var dsnPasswordRX = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|[^&\s]+)`)
+
+// redactDSN hides the password in a PostgreSQL DSN, in either the URL or the key/value format.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		dsn = u.Redacted()
+	}
+	return dsnPasswordRX.ReplaceAllString(dsn, "${1}xxxxx")
+}
+
+// configCommand implements "atla config print", which prints the effective configuration as
+// JSON, with secrets redacted.
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("usage: atla config print [flags]")
+	}
+
+	_, settings, err := loadConfig("atla config print", args[1:], os.LookupEnv)
+	var problems configErrors
+	if err != nil && !errors.As(err, &problems) {
+		return err
+	}
+
+	for i, s := range settings {
+		if redact, ok := secretSettings[s.Name]; ok && s.Value != "" {
+			settings[i].Value = redact(s.Value)
+		}
+	}
+
+	data := envelope{"config": settings}
+	if problems != nil {
+		data["errors"] = problems
+	}
+	if err := printJSON(data); err != nil {
+		return err
+	}
+
+	if problems != nil {
+		return errors.New("the configuration is invalid")
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// readConfigFile reads a YAML or TOML configuration file, depending on its extension, and
+// returns its settings by flag name. Nested keys are joined with dashes and underscores become
+// dashes, so that auth_rps under limiter sets -limiter-auth-rps in both formats. Lists are
+// joined with commas.
+//
+// Only the subset of both formats that a flat set of settings needs is supported, see
+// configFileSubset.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		values, err = parseYAML(string(data))
+	case ".toml":
+		values, err = parseTOML(string(data))
+	default:
+		return nil, fmt.Errorf("%s: unsupported file type, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w (the file may only hold %s)", path, err, configFileSubset)
+	}
+	return values, nil
+}
+
+// configFileSubset describes the part of YAML and TOML that readConfigFile understands. Anchors,
+// tags, multi-line strings, flow mappings, inline tables, arrays of tables and sequences of
+// mappings are rejected.
+const configFileSubset = "nested mappings or tables of strings, numbers, booleans and single-line lists of those"
+
+// parseTOML parses key/value pairs, [table] headers and dotted keys.
+func parseTOML(data string) (map[string]string, error) {
+	values := make(map[string]string)
+	var table string
+
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if strings.HasPrefix(line, "[[") || !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid table header", n+1)
+			}
+			table = settingName(strings.TrimSuffix(strings.TrimPrefix(line, "["), "]"))
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n+1)
+		}
+
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, "{") {
+			return nil, fmt.Errorf("line %d: inline tables aren't supported", n+1)
+		}
+		v, err := parseConfigValue(value, false)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+
+		name := joinSettingName(table, settingName(key))
+		if _, exists := values[name]; exists {
+			return nil, fmt.Errorf("line %d: %s is set twice", n+1, name)
+		}
+		values[name] = v
+	}
+
+	return values, nil
+}
+
+// parseYAML parses block mappings, block sequences of scalars and flow sequences.
+func parseYAML(data string) (map[string]string, error) {
+	values := make(map[string]string)
+
+	// parents are the keys, with their indentation, of the mappings or sequences that the
+	// current line may belong to.
+	type parent struct {
+		indent int
+		name   string
+	}
+	var parents []parent
+
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(stripComment(line), " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", n+1)
+		}
+		indent := len(line) - len(trimmed)
+
+		// A sequence entry belongs to the closest key that is indented less or as much.
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			for len(parents) > 0 && parents[len(parents)-1].indent > indent {
+				parents = parents[:len(parents)-1]
+			}
+			if len(parents) == 0 {
+				return nil, fmt.Errorf("line %d: sequence entry without a key", n+1)
+			}
+
+			item := strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+			if strings.Contains(item, ": ") && !strings.HasPrefix(item, `"`) && !strings.HasPrefix(item, "'") {
+				return nil, fmt.Errorf("line %d: sequences of mappings aren't supported", n+1)
+			}
+			v, err := parseConfigScalar(item, true)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+
+			name := parents[len(parents)-1].name
+			if values[name] != "" {
+				v = values[name] + "," + v
+			}
+			values[name] = v
+			continue
+		}
+
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok || (value != "" && value[0] != ' ') {
+			return nil, fmt.Errorf("line %d: expected key: value", n+1)
+		}
+		value = strings.TrimSpace(value)
+
+		for len(parents) > 0 && parents[len(parents)-1].indent >= indent {
+			parents = parents[:len(parents)-1]
+		}
+		var prefix string
+		if len(parents) > 0 {
+			prefix = parents[len(parents)-1].name
+		}
+		name := joinSettingName(prefix, settingName(key))
+
+		if _, exists := values[name]; exists {
+			return nil, fmt.Errorf("line %d: %s is set twice", n+1, name)
+		}
+
+		// A key without a value opens a nested mapping or a block sequence.
+		if value == "" {
+			parents = append(parents, parent{indent: indent, name: name})
+			continue
+		}
+
+		switch value[0] {
+		case '{', '|', '>':
+			return nil, fmt.Errorf("line %d: flow mappings and block scalars aren't supported", n+1)
+		case '&', '*', '!':
+			return nil, fmt.Errorf("line %d: anchors, aliases and tags aren't supported", n+1)
+		}
+		v, err := parseConfigValue(value, true)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		values[name] = v
+	}
+
+	return values, nil
+}
+
+// settingName turns a possibly dotted key of a configuration file into a flag name.
+func settingName(key string) string {
+	parts := strings.Split(strings.TrimSpace(key), ".")
+	for i, part := range parts {
+		part = strings.Trim(strings.TrimSpace(part), `"'`)
+		parts[i] = strings.ReplaceAll(strings.ToLower(part), "_", "-")
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinSettingName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "-" + name
+}
+
+// parseConfigValue parses a scalar or a single-line list of scalars, which is joined with
+// commas. yaml selects the YAML rules for single-quoted strings over the TOML ones.
+func parseConfigValue(s string, yaml bool) (string, error) {
+	if !strings.HasPrefix(s, "[") {
+		return parseConfigScalar(s, yaml)
+	}
+	if !strings.HasSuffix(s, "]") {
+		return "", fmt.Errorf("unterminated list")
+	}
+
+	var items []string
+	for _, item := range strings.Split(s[1:len(s)-1], ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		v, err := parseConfigScalar(item, yaml)
+		if err != nil {
+			return "", err
+		}
+		items = append(items, v)
+	}
+	return strings.Join(items, ","), nil
+}
+
+// parseConfigScalar unquotes a double-quoted string, with Go (and TOML) escapes, or a
+// single-quoted string. In YAML, a doubled quote stands for a quote inside a single-quoted string,
+// while a TOML literal string can't contain a quote at all. Anything else is taken as it is.
+func parseConfigScalar(s string, yaml bool) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted string %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("invalid quoted string %s", s)
+		}
+		v := s[1 : len(s)-1]
+		if !yaml {
+			if strings.Contains(v, "'") {
+				return "", fmt.Errorf("invalid quoted string %s", s)
+			}
+			return v, nil
+		}
+		if strings.Contains(strings.ReplaceAll(v, "''", ""), "'") {
+			return "", fmt.Errorf("invalid quoted string %s", s)
+		}
+		return strings.ReplaceAll(v, "''", "'"), nil
+	}
+	return s, nil
+}
+
+// stripComment removes a # comment from line, ignoring # inside quoted strings and, as YAML
+// does, # that isn't preceded by a space. Quotes only open a string at the start of a value, so
+// that apostrophes in plain values are left alone.
+func stripComment(line string) string {
+	var quote rune
+	escaped := false
+
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote == '\'' && r == '\'' && strings.HasPrefix(line[i+1:], "'"):
+			// A doubled quote stays inside a single-quoted string.
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case (r == '"' || r == '\'') && (i == 0 || strings.ContainsRune(" \t:=[,", rune(line[i-1]))):
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
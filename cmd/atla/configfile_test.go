@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "nested mappings",
+			data: "port: 4000\nlimiter:\n  enabled: true\n  auth_rps: 2.5\n  burst:\n    auth: 4\nenv: production\n",
+			want: map[string]string{
+				"port":               "4000",
+				"limiter-enabled":    "true",
+				"limiter-auth-rps":   "2.5",
+				"limiter-burst-auth": "4",
+				"env":                "production",
+			},
+		},
+		{
+			name: "block sequence",
+			data: "cors:\n  trusted_origins:\n    - http://localhost:9000\n    - \"http://localhost:9001\"\n  allow_credentials: true\n",
+			want: map[string]string{
+				"cors-trusted-origins":   "http://localhost:9000,http://localhost:9001",
+				"cors-allow-credentials": "true",
+			},
+		},
+		{
+			name: "flow sequence",
+			data: "cors:\n  trusted_origins: [http://a.test, 'http://b.test']\n",
+			want: map[string]string{"cors-trusted-origins": "http://a.test,http://b.test"},
+		},
+		{
+			name: "comments",
+			data: "# settings\n---\nport: 4000 # the API port\nsmtp:\n  # the relay\n  host: mail.test#1\n",
+			want: map[string]string{"port": "4000", "smtp-host": "mail.test#1"},
+		},
+		{
+			name: "quoting",
+			data: "a: \"tab\\there # not a comment\"\nb: 'it''s # not a comment'\nc: don't\nd: ''\n",
+			want: map[string]string{"a": "tab\there # not a comment", "b": "it's # not a comment", "c": "don't", "d": ""},
+		},
+		{name: "lone quote in single-quoted string", data: "a: 'it's'\n", wantErr: true},
+		{name: "unterminated string", data: "a: \"open\n", wantErr: true},
+		{name: "set twice", data: "a: 1\na: 2\n", wantErr: true},
+		{name: "sequence without a key", data: "- 1\n", wantErr: true},
+		{name: "sequence of mappings", data: "a:\n  - b: 1\n", wantErr: true},
+		{name: "flow mapping", data: "a: {b: 1}\n", wantErr: true},
+		{name: "tab indentation", data: "a:\n\tb: 1\n", wantErr: true},
+		{name: "block scalar", data: "a: |-\n  b\n", wantErr: true},
+		{name: "anchor", data: "a: &x 1\n", wantErr: true},
+		{name: "tag", data: "a: !!str 1\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "tables and dotted keys",
+			data: "port = 4000\n[limiter]\nenabled = true\nauth_rps = 2.5\nburst.auth = 4\n[smtp]\nhost = \"mail.test\"\n",
+			want: map[string]string{
+				"port":               "4000",
+				"limiter-enabled":    "true",
+				"limiter-auth-rps":   "2.5",
+				"limiter-burst-auth": "4",
+				"smtp-host":          "mail.test",
+			},
+		},
+		{
+			name: "arrays",
+			data: "[cors]\ntrusted_origins = [\"http://a.test\", 'http://b.test', ]\n",
+			want: map[string]string{"cors-trusted-origins": "http://a.test,http://b.test"},
+		},
+		{
+			name: "comments",
+			data: "# settings\nport = 4000 # the API port\n[smtp] # the relay\nsender = \"ATLA <no-reply@atla.test> # not a comment\"\n",
+			want: map[string]string{"port": "4000", "smtp-sender": "ATLA <no-reply@atla.test> # not a comment"},
+		},
+		{
+			name: "quoting",
+			data: "a = \"say \\\"hi\\\"\"\nb = 'C:\\path\\no-escapes'\nc = ''\n",
+			want: map[string]string{"a": `say "hi"`, "b": `C:\path\no-escapes`, "c": ""},
+		},
+		{name: "quote in literal string", data: "a = 'it''s'\n", wantErr: true},
+		{name: "unterminated array", data: "a = [1, 2\n", wantErr: true},
+		{name: "array of tables", data: "[[a]]\n", wantErr: true},
+		{name: "inline table", data: "a = {b = 1}\n", wantErr: true},
+		{name: "missing value", data: "a\n", wantErr: true},
+		{name: "set twice", data: "[a]\nb = 1\n[a]\nb = 2\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -16,6 +16,11 @@ const userContextKey = contextKey("user")
 // contextSetUser returns a new copy of the request with the provided User struct added to the
 // context.
 func (app *application) contextSetUser(r *http.Request, user *model.User) *http.Request {
+	// Record the user for the access log too.
+	if info := app.contextGetRequestInfo(r); info != nil {
+		info.user = user
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
@@ -31,3 +36,44 @@ func (app *application) contextGetUser(r *http.Request) *model.User {
 
 	return user
 }
+
+// versionContextKey is used as a key for the API version ("v1" or "v2") that matched the request.
+const versionContextKey = contextKey("version")
+
+// contextSetVersion returns a new copy of the request with the API version added to the context.
+func (app *application) contextSetVersion(r *http.Request, version string) *http.Request {
+	ctx := context.WithValue(r.Context(), versionContextKey, version)
+	return r.WithContext(ctx)
+}
+
+// contextGetVersion retrieves the API version from the request context. Requests which didn't
+// match a versioned subrouter (e.g. a 404 for an unknown path) are treated as v1.
+func (app *application) contextGetVersion(r *http.Request) string {
+	version, ok := r.Context().Value(versionContextKey).(string)
+	if !ok {
+		return "v1"
+	}
+
+	return version
+}
+
+// requestInfoContextKey is used as a key for the *requestInfo of the access log.
+const requestInfoContextKey = contextKey("requestInfo")
+
+// contextSetRequestInfo returns a new copy of the request with info added to the context.
+func (app *application) contextSetRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), requestInfoContextKey, info)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestInfo retrieves the *requestInfo from the request context, or nil if the request
+// didn't go through logRequests. Batch sub-requests share the *requestInfo of the batch.
+func (app *application) contextGetRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	return info
+}
+
+// contextGetRequestID retrieves the ID which the requestID middleware gave to the request.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	return model.RequestIDFromContext(r.Context())
+}
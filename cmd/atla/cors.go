@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// corsMethods are the methods probed against the router to answer preflight requests.
+var corsMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// corsExposedHeaders are the response headers, besides the CORS-safelisted ones, that scripts on
+// a trusted origin are allowed to read.
+var corsExposedHeaders = []string{
+	"Deprecation", "Link", "Sunset", "Retry-After",
+	"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset",
+	"X-Metadata", "X-Request-ID",
+}
+
+// enableCORS lets browser frontends on the origins listed in -cors-trusted-origins call the API.
+// The Origin of a request from a trusted origin is echoed back in Access-Control-Allow-Origin.
+// Preflight requests are answered directly, with the methods that the router actually accepts
+// for the requested path.
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on the Origin header, so caches must keep a copy per origin even
+		// when the origin isn't trusted.
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		cors := app.corsConfig()
+
+		origin := r.Header.Get("Origin")
+		if origin == "" || !cors.isTrustedOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if cors.allowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		// A preflight request is an OPTIONS request carrying Access-Control-Request-Method.
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		methods := app.allowedMethods(r)
+		if len(methods) == 0 {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(append(methods, http.MethodOptions), ", "))
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Accept")
+		if cors.maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cors.maxAge.Seconds())))
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// corsConfig returns the current CORS settings.
+func (app *application) corsConfig() corsConfig {
+	app.live.RLock()
+	defer app.live.RUnlock()
+	return app.config.cors
+}
+
+// isTrustedOrigin reports whether origin is one of the -cors-trusted-origins. The single
+// origin "*" trusts every origin.
+func (c corsConfig) isTrustedOrigin(origin string) bool {
+	for _, trusted := range c.trustedOrigins {
+		if trusted == "*" || strings.EqualFold(origin, trusted) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedMethods returns the methods for which the router has a route matching the path of r.
+func (app *application) allowedMethods(r *http.Request) []string {
+	router, ok := app.router.(*mux.Router)
+	if !ok {
+		return nil
+	}
+
+	var methods []string
+	for _, method := range corsMethods {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+
+		var match mux.RouteMatch
+		if router.Match(probe, &match) && match.MatchErr == nil {
+			methods = append(methods, method)
+		}
+	}
+
+	return methods
+}
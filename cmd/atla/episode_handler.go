@@ -11,14 +11,24 @@ import (
 	"github.com/justverena/ATLA/pkg/atla/validator"
 )
 
+// createEpisodeInput is the request body accepted by createEpisodeHandler.
+type createEpisodeInput struct {
+	ID       int    `json:"id,omitempty"`
+	Title    string `json:"title"`
+	Air_Date string `json:"air_date"`
+	// CreatedAt string `json:"createdAt"`
+	// UpdatedAt string `json:"updatedAt"`
+}
+
+// updateEpisodeInput is the request body accepted by updateEpisodeHandler.
+type updateEpisodeInput struct {
+	ID       *int    `json:"id"`
+	Title    *string `json:"title"`
+	Air_Date *string `json:"air_date"`
+}
+
 func (app *application) createEpisodeHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		ID       int    `json:"id"`
-		Title    string `json:"title"`
-		Air_Date string `json:"air_date"`
-		// CreatedAt string `json:"createdAt"`
-		// UpdatedAt string `json:"updatedAt"`
-	}
+	var input createEpisodeInput
 
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -35,13 +45,13 @@ func (app *application) createEpisodeHandler(w http.ResponseWriter, r *http.Requ
 		// UpdatedAt: input.UpdatedAt,
 	}
 
-	err = app.models.Episodes.Insert(episode)
+	err = app.models.Episodes.Insert(r.Context(), episode)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusCreated, envelope{"episodes": episode}, nil)
+	app.render(w, r, http.StatusCreated, envelope{"episodes": app.episodeResource(r, episode)}, nil)
 }
 
 func (app *application) getEpisodeList(w http.ResponseWriter, r *http.Request) {
@@ -67,13 +77,20 @@ func (app *application) getEpisodeList(w http.ResponseWriter, r *http.Request) {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	episodes, metadata, err := app.models.Episodes.GetAll(input.Title, input.Filters)
+	episodes, metadata, err := app.models.Episodes.GetAll(r.Context(), input.Title, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"episodes": episodes, "metadata": metadata}, nil)
+	// The prev and next links of an episode change when its neighbours do, so they are part of
+	// the validator too.
+	fingerprint := listFingerprint(episodes, (*model.Episode).Stamp)
+	if app.listNotModified(w, r, fingerprint, metadata.TotalRecords, episodeNeighbours(episodes...)) {
+		return
+	}
+
+	app.render(w, r, http.StatusOK, envelope{"episodes": app.episodeResources(r, episodes), "metadata": app.listMetadata(r, "/episodes", metadata)}, nil)
 }
 
 func (app *application) getEpisodeHandler(w http.ResponseWriter, r *http.Request) {
@@ -83,7 +100,7 @@ func (app *application) getEpisodeHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	episode, err := app.models.Episodes.Get(id)
+	episode, err := app.models.Episodes.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -94,7 +111,11 @@ func (app *application) getEpisodeHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"episodes": episode}, nil)
+	if app.notModified(w, r, episode.UpdatedAt, episode.ID, episodeNeighbours(episode)) {
+		return
+	}
+
+	app.render(w, r, http.StatusOK, envelope{"episodes": app.episodeResource(r, episode)}, nil)
 }
 
 func (app *application) updateEpisodeHandler(w http.ResponseWriter, r *http.Request) {
@@ -104,7 +125,7 @@ func (app *application) updateEpisodeHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	episode, err := app.models.Episodes.Get(id)
+	episode, err := app.models.Episodes.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -115,11 +136,7 @@ func (app *application) updateEpisodeHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	var input struct {
-		ID       *int    `json:"id"`
-		Title    *string `json:"title"`
-		Air_Date *string `json:"air_date"`
-	}
+	var input updateEpisodeInput
 
 	err = app.readJSON(w, r, &input)
 	if err != nil {
@@ -140,7 +157,7 @@ func (app *application) updateEpisodeHandler(w http.ResponseWriter, r *http.Requ
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	err = app.models.Episodes.Update(episode)
+	err = app.models.Episodes.Update(r.Context(), episode)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -151,7 +168,7 @@ func (app *application) updateEpisodeHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"episodes": episode}, nil)
+	app.render(w, r, http.StatusOK, envelope{"episodes": app.episodeResource(r, episode)}, nil)
 }
 
 func (app *application) deleteEpisodeHandler(w http.ResponseWriter, r *http.Request) {
@@ -161,7 +178,7 @@ func (app *application) deleteEpisodeHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = app.models.Episodes.Delete(id)
+	err = app.models.Episodes.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -172,7 +189,7 @@ func (app *application) deleteEpisodeHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"message": "success"}, nil)
+	app.render(w, r, http.StatusOK, envelope{"message": "success"}, nil)
 }
 
 func (app *application) getCharacterEpisode(w http.ResponseWriter, r *http.Request) {
@@ -183,19 +200,22 @@ func (app *application) getCharacterEpisode(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	character, err := app.models.Characters.Get(characterID)
+	character, err := app.models.Characters.Get(r.Context(), characterID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	episode, err := app.models.Episodes.GetByCharacter(characterID)
+	episode, err := app.models.Episodes.GetByCharacter(r.Context(), characterID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"character": character}, nil)
+	fingerprint := listFingerprint(episode, (*model.Episode).Stamp)
+	if app.listNotModified(w, r, character.ID, character.UpdatedAt.Unix(), fingerprint, episodeNeighbours(episode...)) {
+		return
+	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"episode": episode}, nil)
+	app.render(w, r, http.StatusOK, envelope{"character": app.characterResource(r, character), "episode": app.episodeResources(r, episode)}, nil)
 }
@@ -1,21 +1,28 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 )
 
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
+		"request_id":     app.contextGetRequestID(r),
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
+		"remote_addr":    r.RemoteAddr,
 	})
 }
 
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
-	env := envelope{"error": message}
+	env := envelope{"error": message, "request_id": app.contextGetRequestID(r)}
 
-	err := app.writeJSON(w, status, env, nil)
+	// Errors must never be cached, whatever the Cache-Control policy of the route.
+	w.Header().Set("Cache-Control", "no-store")
+
+	err := app.render(w, r, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
@@ -23,6 +30,12 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 }
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// A query cancelled because the client went away isn't a server problem, and there is no one
+	// left to read the response.
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		return
+	}
+
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request"
@@ -38,6 +51,27 @@ func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
+// notAcceptableResponse is always written as JSON, since by definition we couldn't agree with the
+// client on any other representation.
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("the requested representation is not supported, use one of: %s", supportedContentTypes())
+	err := app.writeJSON(w, http.StatusNotAcceptable, envelope{"error": message, "request_id": app.contextGetRequestID(r)}, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the request body must be sent with Content-Type: application/json"
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := "rate limit exceeded"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
 }
@@ -52,11 +86,15 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+	app.metrics.authFailures.Add("invalid_credentials", 1)
+
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	app.metrics.authFailures.Add("invalid_token", 1)
+
 	w.Header().Set("WWWW-Authenticate", "Bearer")
 
 	message := "invalid or missing authentication token"
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/justverena/ATLA/pkg/atla/migrations"
+	"github.com/justverena/ATLA/pkg/atla/model"
+)
+
+// version is the build version reported by the healthcheck. Release builds set it with
+// -ldflags "-X main.version=1.2.3".
+var version = "1.0.0"
+
+// schemaVersion is the database migration version this binary expects, the last of the
+// migrations embedded from pkg/atla/migrations.
+var schemaVersion = migrations.Latest()
+
+// readinessTimeout bounds the database checks of readyzHandler, so that a hanging database
+// makes the probe fail rather than time out.
+const readinessTimeout = 2 * time.Second
+
+// healthcheckHandler reports that the process is alive, along with its environment, version and
+// whether it is the leader of the instances. It doesn't touch the database, see readyzHandler for
+// that.
+func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{
+		"status": "available",
+		"system_info": map[string]string{
+			"environment": app.config.env,
+			"version":     version,
+		},
+		"leadership": app.elector.Status(),
+	}
+
+	err := app.render(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readyzHandler tells load balancers whether to send us traffic. It answers 503 Service
+// Unavailable when the database can't be reached, when its schema isn't at the version this
+// binary expects, and as soon as a shutdown has started, so that we are drained before the
+// server stops accepting connections.
+func (app *application) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"shutdown": "ok",
+		"database": "ok",
+		"schema":   "ok",
+	}
+	ready := true
+
+	if app.shuttingDown.Load() {
+		checks["shutdown"] = "shutting down"
+		ready = false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	if err := app.db.PingContext(ctx); err != nil {
+		checks["database"] = err.Error()
+		checks["schema"] = "unknown"
+		ready = false
+	} else if err := checkSchemaVersion(ctx, app.db); err != nil {
+		checks["schema"] = err.Error()
+		ready = false
+	}
+
+	status, text := http.StatusOK, "ready"
+	if !ready {
+		status, text = http.StatusServiceUnavailable, "unavailable"
+	}
+
+	err := app.render(w, r, status, envelope{"status": text, "checks": checks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkSchemaVersion returns an error if the database schema isn't at schemaVersion, or if the
+// last migration failed half way.
+func checkSchemaVersion(ctx context.Context, db *sql.DB) error {
+	current, dirty, err := model.SchemaVersion(ctx, db)
+	if err != nil {
+		if errors.Is(err, model.ErrRecordNotFound) {
+			return errors.New("no migrations have been applied")
+		}
+		return err
+	}
+
+	switch {
+	case dirty:
+		return fmt.Errorf("migration %d is dirty", current)
+	case current != schemaVersion:
+		return fmt.Errorf("schema is at version %d, expected %d", current, schemaVersion)
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/justverena/ATLA/pkg/atla/validator"
@@ -202,3 +203,45 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	// Otherwise, return the converted integer value.
 	return i
 }
+
+// task is a goroutine started with background.
+type task struct {
+	name    string
+	started time.Time
+}
+
+// background runs fn in a goroutine tracked by app.wg, so that the graceful shutdown waits for it
+// to finish. name describes the task in the log when it is still running at the end of the
+// shutdown. A panic in fn is logged instead of crashing the whole application.
+func (app *application) background(name string, fn func()) {
+	app.wg.Add(1)
+
+	app.tasksMu.Lock()
+	if app.tasks == nil {
+		app.tasks = make(map[uint64]task)
+	}
+	app.taskSeq++
+	id := app.taskSeq
+	app.tasks[id] = task{name: name, started: time.Now()}
+	app.tasksMu.Unlock()
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			app.tasksMu.Lock()
+			delete(app.tasks, id)
+			app.tasksMu.Unlock()
+		}()
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%v", err), map[string]string{
+					"task": name,
+				})
+			}
+		}()
+
+		fn()
+	}()
+}
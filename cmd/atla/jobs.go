@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/justverena/ATLA/pkg/atla/jobs"
+	"github.com/justverena/ATLA/pkg/atla/model"
+	"github.com/justverena/ATLA/pkg/atla/schedule"
+	"github.com/justverena/ATLA/pkg/atla/validator"
+)
+
+// The kinds of background job run by the API.
+const (
+	jobPurgeTokens = "purge-expired-tokens"
+	jobPurgeUsers  = "purge-unactivated-users"
+)
+
+// jobOptions are the options of the kinds of background job. -shutdown-tasks-timeout has to
+// leave the longest of their timeouts to the jobs running when the server stops.
+var jobOptions = map[string]jobs.Options{
+	jobPurgeTokens: {},
+	jobPurgeUsers:  {},
+}
+
+// longestJobTimeout returns the longest time a background job may run for. It is never less
+// than jobs.DefaultTimeout, so that the shutdown wait holds before any kind is registered.
+func longestJobTimeout() time.Duration {
+	longest := jobs.DefaultTimeout
+	for _, opts := range jobOptions {
+		longest = max(longest, opts.Timeout)
+	}
+	return longest
+}
+
+// purgeUsersPayload is the payload of the purge-unactivated-users jobs.
+type purgeUsersPayload struct {
+	// Days is how old unactivated users have to be to be deleted.
+	Days int `json:"days"`
+}
+
+// scheduleStatus is a periodic job, with the last job it enqueued.
+type scheduleStatus struct {
+	schedule.Entry
+	LastJob *model.Job `json:"last_job"`
+}
+
+// registerJobs registers the handlers of the background jobs, and schedules the periodic ones
+// with the -schedule-* settings.
+func (app *application) registerJobs() {
+	jobs.Register(app.queue, jobPurgeTokens, jobOptions[jobPurgeTokens], func(ctx context.Context, _ struct{}) error {
+		n, err := app.models.Tokens.DeleteExpired(ctx)
+		if err != nil {
+			return err
+		}
+		app.logger.PrintInfo("purged expired tokens", map[string]string{
+			"deleted": strconv.FormatInt(n, 10),
+		})
+		return nil
+	})
+
+	jobs.Register(app.queue, jobPurgeUsers, jobOptions[jobPurgeUsers], func(ctx context.Context, p purgeUsersPayload) error {
+		if p.Days < 1 {
+			return jobs.Permanent(errors.New("days must be at least 1"))
+		}
+		n, err := app.models.Users.DeleteUnactivated(ctx, time.Now().AddDate(0, 0, -p.Days))
+		if err != nil {
+			return err
+		}
+		app.logger.PrintInfo("purged unactivated users", map[string]string{
+			"deleted": strconv.FormatInt(n, 10),
+			"days":    strconv.Itoa(p.Days),
+		})
+		return nil
+	})
+
+	payloads := map[string]interface{}{
+		jobPurgeTokens: struct{}{},
+		jobPurgeUsers:  purgeUsersPayload{Days: app.config.jobs.unactivatedUsersDays},
+	}
+	for kind, c := range app.config.jobs.schedules {
+		kind, payload := kind, payloads[kind]
+		app.scheduler.Add(kind, c, func(ctx context.Context) error {
+			_, err := app.queue.Enqueue(ctx, kind, payload)
+			return err
+		})
+	}
+}
+
+// listJobsHandler lists the jobs of the queue, most recent first, so that failed and dead jobs
+// can be inspected.
+func (app *application) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		Kind   string
+		model.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Status = app.readStrings(qs, "status", "")
+	input.Kind = app.readStrings(qs, "kind", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readStrings(qs, "sort", "-id")
+
+	input.Filters.SortSafeList = []string{
+		"id", "run_at", "updated_at",
+		"-id", "-run_at", "-updated_at",
+	}
+
+	v.Check(input.Status == "" || validator.In(input.Status, model.JobStatuses...), "status", "invalid status value")
+	if model.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	list, metadata, err := app.models.Jobs.GetAll(r.Context(), input.Status, input.Kind, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.render(w, r, http.StatusOK, envelope{"jobs": list, "metadata": app.listMetadata(r, "/jobs", metadata)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// retryJobHandler makes a dead job, or one waiting for its next attempt, run again straight away.
+func (app *application) retryJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	job, err := app.models.Jobs.Retry(r.Context(), int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, model.ErrJobNotRetryable):
+			app.errorResponse(w, r, http.StatusConflict, "only dead and pending jobs can be retried")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.render(w, r, http.StatusOK, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listSchedulesHandler lists the periodic jobs with their schedule, when they run next and the
+// last job they enqueued, which tells how the last run went. Only the leader enqueues them, so
+// the leadership of the instance that answers is included.
+func (app *application) listSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	last := model.Filters{Page: 1, PageSize: 1, Sort: "-id", SortSafeList: []string{"-id"}}
+
+	entries := app.scheduler.Entries()
+	schedules := make([]scheduleStatus, 0, len(entries))
+	for _, entry := range entries {
+		recent, _, err := app.models.Jobs.GetAll(r.Context(), "", entry.Name, last)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		status := scheduleStatus{Entry: entry}
+		if len(recent) > 0 {
+			status.LastJob = recent[0]
+		}
+		schedules = append(schedules, status)
+	}
+
+	err := app.render(w, r, http.StatusOK, envelope{"schedules": schedules, "leadership": app.elector.Status()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
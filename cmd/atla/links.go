@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/justverena/ATLA/pkg/atla/model"
+)
+
+// link is a single hypermedia link in HAL style, e.g. {"href": "/api/v1/characters/1"}.
+type link struct {
+	Href string `json:"href"`
+}
+
+// links holds the "_links" member of a resource, keyed by relation name.
+type links map[string]link
+
+// characterResource is a character as it is sent to clients, along with its links.
+type characterResource struct {
+	*model.Character
+	Links links `json:"_links"`
+}
+
+// episodeResource is an episode as it is sent to clients, along with its links.
+type episodeResource struct {
+	*model.Episode
+	Links links `json:"_links"`
+}
+
+// quoteResource is a quote as it is sent to clients, along with its links.
+type quoteResource struct {
+	*model.Quote
+	Links links `json:"_links"`
+}
+
+// listMetadata extends the pagination metadata of list responses with ready-to-follow URLs for
+// the first, previous, next and last pages.
+type listMetadata struct {
+	model.Metadata
+	First string `json:"first,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Last  string `json:"last,omitempty"`
+}
+
+// apiPrefix returns the path prefix of the API version that served the request.
+func (app *application) apiPrefix(r *http.Request) string {
+	return apiVersions[app.contextGetVersion(r)]
+}
+
+// url builds an absolute link to path within the API version of the request. When the API is
+// served behind a reverse proxy, -base-url is prepended so that clients get URLs they can follow.
+func (app *application) url(r *http.Request, path string, query url.Values) string {
+	u := app.config.baseURL + app.apiPrefix(r) + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+func (app *application) characterResource(r *http.Request, character *model.Character) characterResource {
+	self := fmt.Sprintf("/characters/%d", character.ID)
+
+	return characterResource{
+		Character: character,
+		Links: links{
+			"self":     {app.url(r, self, nil)},
+			"episodes": {app.url(r, self+"/episode", nil)},
+			"quotes":   {app.url(r, self+"/quotes", nil)},
+		},
+	}
+}
+
+func (app *application) characterResources(r *http.Request, characters []*model.Character) []characterResource {
+	resources := make([]characterResource, 0, len(characters))
+	for _, character := range characters {
+		resources = append(resources, app.characterResource(r, character))
+	}
+	return resources
+}
+
+func (app *application) episodeResource(r *http.Request, episode *model.Episode) episodeResource {
+	self := fmt.Sprintf("/episodes/%d", episode.ID)
+
+	l := links{
+		"self":       {app.url(r, self, nil)},
+		"characters": {app.url(r, self+"/characters", nil)},
+	}
+	if episode.PrevID != nil {
+		l["prev"] = link{app.url(r, fmt.Sprintf("/episodes/%d", *episode.PrevID), nil)}
+	}
+	if episode.NextID != nil {
+		l["next"] = link{app.url(r, fmt.Sprintf("/episodes/%d", *episode.NextID), nil)}
+	}
+
+	return episodeResource{Episode: episode, Links: l}
+}
+
+func (app *application) episodeResources(r *http.Request, episodes []*model.Episode) []episodeResource {
+	resources := make([]episodeResource, 0, len(episodes))
+	for _, episode := range episodes {
+		resources = append(resources, app.episodeResource(r, episode))
+	}
+	return resources
+}
+
+func (app *application) quoteResource(r *http.Request, quote *model.Quote) quoteResource {
+	self := fmt.Sprintf("/quotes/%d", quote.ID)
+
+	return quoteResource{
+		Quote: quote,
+		Links: links{
+			"self":      {app.url(r, self, nil)},
+			"character": {app.url(r, self+"/character", nil)},
+		},
+	}
+}
+
+func (app *application) quoteResources(r *http.Request, quotes []*model.Quote) []quoteResource {
+	resources := make([]quoteResource, 0, len(quotes))
+	for _, quote := range quotes {
+		resources = append(resources, app.quoteResource(r, quote))
+	}
+	return resources
+}
+
+// listMetadata adds page links to the metadata of a list response. The links keep every query
+// string parameter of the current request (filters, sort, format...) and only change the page.
+func (app *application) listMetadata(r *http.Request, path string, metadata model.Metadata) listMetadata {
+	lm := listMetadata{Metadata: metadata}
+	if metadata.LastPage == 0 {
+		return lm
+	}
+
+	page := func(n int) string {
+		qs := r.URL.Query()
+		qs.Set("page", strconv.Itoa(n))
+		return app.url(r, path, qs)
+	}
+
+	lm.First = page(metadata.FirstPage)
+	lm.Last = page(metadata.LastPage)
+	if metadata.CurrentPage > metadata.FirstPage {
+		lm.Prev = page(metadata.CurrentPage - 1)
+	}
+	if metadata.CurrentPage < metadata.LastPage {
+		lm.Next = page(metadata.CurrentPage + 1)
+	}
+
+	return lm
+}
+
+// episodeNeighbours describes the prev and next links of episodes, for use in validators.
+func episodeNeighbours(episodes ...*model.Episode) string {
+	var b strings.Builder
+	for _, episode := range episodes {
+		if episode.PrevID != nil {
+			fmt.Fprintf(&b, "%d", *episode.PrevID)
+		}
+		b.WriteByte('<')
+		if episode.NextID != nil {
+			fmt.Fprintf(&b, "%d", *episode.NextID)
+		}
+		b.WriteByte(';')
+	}
+	return b.String()
+}
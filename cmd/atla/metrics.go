@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justverena/ATLA/pkg/atla/leader"
+	"github.com/justverena/ATLA/pkg/atla/model"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request duration histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// unmatchedRoute is the route label of requests which didn't match any route, so that scanners
+// probing random paths can't create an unbounded number of label values.
+const unmatchedRoute = "unmatched"
+
+// routeStatus identifies a request counter.
+type routeStatus struct {
+	route  string
+	status int
+}
+
+// histogram counts observations in latencyBuckets. counts[i] is the number of observations in
+// bucket i alone, and the last element counts those above the largest bound.
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// metrics holds the application metrics. They are exposed both as expvar variables, on
+// /debug/metrics, and in the Prometheus text format.
+type metrics struct {
+	db     *sql.DB
+	cache  *model.Cache    // nil unless -model-cache-enabled
+	leader *leader.Elector // nil outside of the server
+
+	inFlight     expvar.Int
+	tokenLookups expvar.Int
+	authFailures expvar.Map
+
+	mu       sync.Mutex
+	requests map[routeStatus]int64
+	latency  map[string]*histogram
+}
+
+func newMetrics(db *sql.DB) *metrics {
+	m := &metrics{
+		db:       db,
+		requests: make(map[routeStatus]int64),
+		latency:  make(map[string]*histogram),
+	}
+	m.authFailures.Init()
+	return m
+}
+
+// publish registers the metrics with expvar. It must only be called once per process, since
+// expvar panics when a name is published twice.
+func (m *metrics) publish() {
+	expvar.Publish("requests", expvar.Func(m.requestsSnapshot))
+	expvar.Publish("requests_in_flight", &m.inFlight)
+	expvar.Publish("token_lookups", &m.tokenLookups)
+	expvar.Publish("auth_failures", &m.authFailures)
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("model_cache", expvar.Func(func() interface{} {
+		if m.cache == nil {
+			return nil
+		}
+		return m.cache.Stats()
+	}))
+	expvar.Publish("leadership", expvar.Func(func() interface{} {
+		if m.leader == nil {
+			return nil
+		}
+		return m.leader.Status()
+	}))
+	expvar.Publish("database", expvar.Func(func() interface{} {
+		if m.db == nil {
+			return nil
+		}
+		return m.db.Stats()
+	}))
+}
+
+// observe records a finished request.
+func (m *metrics) observe(route string, status int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[routeStatus{route, status}]++
+
+	h, ok := m.latency[route]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(latencyBuckets)+1)}
+		m.latency[route] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// requestsSnapshot returns the request counters by route and status, e.g.
+// {"GET /api/v1/characters/{id}": {"200": 10, "404": 1}}.
+func (m *metrics) requestsSnapshot() interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[string]map[string]int64)
+	for k, n := range m.requests {
+		if out[k.route] == nil {
+			out[k.route] = make(map[string]int64)
+		}
+		out[k.route][strconv.Itoa(k.status)] = n
+	}
+	return out
+}
+
+// recordMetrics counts every request by route and status, and records its duration. It relies on
+// the route template which routeHandler stores in the request info, so it has to run inside
+// logRequests.
+func (app *application) recordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		app.metrics.inFlight.Add(1)
+		defer app.metrics.inFlight.Add(-1)
+
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		route := unmatchedRoute
+		if info := app.contextGetRequestInfo(r); info != nil && info.route != "" {
+			route = r.Method + " " + info.route
+		}
+
+		app.metrics.observe(route, rec.status, time.Since(start))
+	})
+}
+
+// metricsRoutes registers the metrics endpoints with handle. They are served on a separate admin
+// listener when -metrics-addr is set, otherwise on the API port behind the metrics:read
+// permission.
+func (app *application) metricsRoutes(handle func(path string, h http.HandlerFunc)) {
+	handle("/debug/metrics", expvarHandler)
+	handle("/debug/metrics/prometheus", app.prometheusHandler)
+}
+
+// hiddenVars are the variables published by the expvar package itself. cmdline holds the
+// command line, -db-dsn password included, and memstats is large and not one of our metrics.
+var hiddenVars = map[string]bool{
+	"cmdline":  true,
+	"memstats": true,
+}
+
+// expvarHandler writes the published expvar variables as a JSON object, like expvar.Handler
+// but without hiddenVars.
+func expvarHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	var b strings.Builder
+	b.WriteString("{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if hiddenVars[kv.Key] {
+			return
+		}
+		if !first {
+			b.WriteString(",\n")
+		}
+		first = false
+		fmt.Fprintf(&b, "%q: %s", kv.Key, kv.Value)
+	})
+	b.WriteString("\n}\n")
+
+	w.Write([]byte(b.String()))
+}
+
+// prometheusHandler writes the metrics in the Prometheus text exposition format.
+func (app *application) prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	m := app.metrics
+
+	m.mu.Lock()
+
+	keys := make([]routeStatus, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	writeMetricHeader(&b, "atla_http_requests_total", "counter", "Number of HTTP requests by route and status.")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "atla_http_requests_total{route=%q,status=\"%d\"} %d\n", k.route, k.status, m.requests[k])
+	}
+
+	routes := make([]string, 0, len(m.latency))
+	for route := range m.latency {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	writeMetricHeader(&b, "atla_http_request_duration_seconds", "histogram", "Duration of HTTP requests by route.")
+	for _, route := range routes {
+		h := m.latency[route]
+
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "atla_http_request_duration_seconds_bucket{route=%q,le=%q} %d\n",
+				route, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(&b, "atla_http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, h.count)
+		fmt.Fprintf(&b, "atla_http_request_duration_seconds_sum{route=%q} %g\n", route, h.sum)
+		fmt.Fprintf(&b, "atla_http_request_duration_seconds_count{route=%q} %d\n", route, h.count)
+	}
+
+	m.mu.Unlock()
+
+	writeMetricHeader(&b, "atla_http_requests_in_flight", "gauge", "Number of HTTP requests being served.")
+	fmt.Fprintf(&b, "atla_http_requests_in_flight %d\n", m.inFlight.Value())
+
+	writeMetricHeader(&b, "atla_token_lookups_total", "counter", "Number of authentication token lookups.")
+	fmt.Fprintf(&b, "atla_token_lookups_total %d\n", m.tokenLookups.Value())
+
+	writeMetricHeader(&b, "atla_auth_failures_total", "counter", "Number of failed authentications by reason.")
+	m.authFailures.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(&b, "atla_auth_failures_total{reason=%q} %s\n", kv.Key, kv.Value.String())
+	})
+
+	writeMetricHeader(&b, "atla_goroutines", "gauge", "Number of goroutines.")
+	fmt.Fprintf(&b, "atla_goroutines %d\n", runtime.NumGoroutine())
+
+	if m.cache != nil {
+		s := m.cache.Stats()
+		writeMetricHeader(&b, "atla_model_cache_requests_total", "counter", "Number of model cache lookups by result.")
+		fmt.Fprintf(&b, "atla_model_cache_requests_total{result=\"hit\"} %d\n", s.Hits)
+		fmt.Fprintf(&b, "atla_model_cache_requests_total{result=\"miss\"} %d\n", s.Misses)
+		writeMetricHeader(&b, "atla_model_cache_evictions_total", "counter", "Number of model cache entries evicted to make room.")
+		fmt.Fprintf(&b, "atla_model_cache_evictions_total %d\n", s.Evictions)
+		writeMetricHeader(&b, "atla_model_cache_entries", "gauge", "Number of entries in the model cache.")
+		fmt.Fprintf(&b, "atla_model_cache_entries %d\n", s.Entries)
+	}
+
+	if m.leader != nil {
+		s := m.leader.Status()
+		leading := 0
+		if s.Leader {
+			leading = 1
+		}
+		writeMetricHeader(&b, "atla_leader", "gauge", "Whether this instance is the leader, which runs the singleton tasks.")
+		fmt.Fprintf(&b, "atla_leader{election=%q} %d\n", s.Name, leading)
+		writeMetricHeader(&b, "atla_leader_elections_total", "counter", "Number of times this instance became the leader.")
+		fmt.Fprintf(&b, "atla_leader_elections_total{election=%q} %d\n", s.Name, s.Elections)
+	}
+
+	if m.db != nil {
+		s := m.db.Stats()
+		for _, stat := range []struct {
+			name, typ, help string
+			value           float64
+		}{
+			{"atla_db_max_open_connections", "gauge", "Maximum number of open connections to the database.", float64(s.MaxOpenConnections)},
+			{"atla_db_open_connections", "gauge", "Number of established connections, in use and idle.", float64(s.OpenConnections)},
+			{"atla_db_in_use_connections", "gauge", "Number of connections currently in use.", float64(s.InUse)},
+			{"atla_db_idle_connections", "gauge", "Number of idle connections.", float64(s.Idle)},
+			{"atla_db_wait_count_total", "counter", "Number of connections waited for.", float64(s.WaitCount)},
+			{"atla_db_wait_duration_seconds_total", "counter", "Time spent waiting for new connections.", s.WaitDuration.Seconds()},
+			{"atla_db_max_idle_closed_total", "counter", "Connections closed due to the idle connection limit.", float64(s.MaxIdleClosed)},
+			{"atla_db_max_idle_time_closed_total", "counter", "Connections closed due to the maximum idle time.", float64(s.MaxIdleTimeClosed)},
+			{"atla_db_max_lifetime_closed_total", "counter", "Connections closed due to the maximum lifetime.", float64(s.MaxLifetimeClosed)},
+		} {
+			writeMetricHeader(&b, stat.name, stat.typ, stat.help)
+			fmt.Fprintf(&b, "%s %g\n", stat.name, stat.value)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+func writeMetricHeader(b *strings.Builder, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
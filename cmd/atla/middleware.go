@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
@@ -9,11 +10,41 @@ import (
 	"github.com/justverena/ATLA/pkg/atla/validator"
 )
 
+// recoverPanic turns a panic in any later middleware or handler into a logged error and a 500
+// Internal Server Error response, rather than a dropped connection. It has to be the outermost
+// middleware so that it covers all of the others.
+func (app *application) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// This deferred function will always be run in the event of a panic as Go unwinds the
+		// stack.
+		defer func() {
+			if err := recover(); err != nil {
+				// http.ErrAbortHandler is used to abort a response on purpose, so let the
+				// server handle it as usual.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				// Setting the "Connection: close" header makes Go's HTTP server close the
+				// connection once the response has been sent.
+				w.Header().Set("Connection", "close")
+
+				// The value returned by recover() has the type interface{}, so we use
+				// fmt.Errorf() to normalize it into an error. serverErrorResponse logs it,
+				// along with the stack trace, through our jsonlog logger.
+				app.serverErrorResponse(w, r, fmt.Errorf("%v", err))
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the "Vary: Authorization" header to the response. This indicates to any caches
 		// that the response may vary based on the value of the Authorization header in the request.
-		w.Header().Set("Vary", "Authorization")
+		w.Header().Add("Vary", "Authorization")
 
 		// Retrieve the value of the Authorization header from teh request. This will return the
 		// empty string "" if there is no such header found.
@@ -53,7 +84,8 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		// Retrieve the details of the user associated with the authentication token.
 		// call invalidAuthenticationTokenResponse if no matching record was found.
-		user, err := app.models.Users.GetForToken(model.ScopeAuthentication, token)
+		app.metrics.tokenLookups.Add(1)
+		user, err := app.models.Users.GetForToken(r.Context(), model.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, model.ErrRecordNotFound):
@@ -114,7 +146,7 @@ func (app *application) requirePermissions(code string, next http.HandlerFunc) h
 		user := app.contextGetUser(r)
 
 		// Get the slice of permission for the user
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
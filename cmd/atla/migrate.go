@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/justverena/ATLA/pkg/atla/migrations"
+	"github.com/justverena/ATLA/pkg/jsonlog"
+)
+
+var errMigrateUsage = errors.New("usage: atla migrate up [n] | down [n] | goto <version> | status | force <version> [flags]")
+
+// migrateCommand implements "atla migrate", which manages the database schema with the
+// migrations built into the binary:
+//
+//	up [n]           apply the next n pending migrations, all of them by default
+//	down [n]         revert the last n migrations, one by default
+//	goto <version>   migrate up or down to version, 0 reverts everything
+//	status           print the current version and the applied migrations
+//	force <version>  set the version without migrating, after repairing a dirty database
+func migrateCommand(args []string) error {
+	positional, flags := splitArgs(args)
+	if len(positional) == 0 {
+		return errMigrateUsage
+	}
+
+	action := positional[0]
+	n := 0
+	switch {
+	case (action == "up" || action == "down") && len(positional) <= 2:
+		if action == "down" {
+			n = 1
+		}
+		if len(positional) == 2 {
+			v, err := strconv.Atoi(positional[1])
+			if err != nil || v < 1 {
+				return fmt.Errorf("the number of migrations must be a positive integer")
+			}
+			n = v
+		}
+	case (action == "goto" || action == "force") && len(positional) == 2:
+		v, err := strconv.Atoi(positional[1])
+		if err != nil || v < 0 {
+			return fmt.Errorf("the version must be a non-negative integer")
+		}
+		n = v
+	case action == "status" && len(positional) == 1:
+	default:
+		return errMigrateUsage
+	}
+
+	db, _, err := commandDB("atla migrate "+action, flags)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Interrupting cancels the migration in progress, which is rolled back.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	m := migrations.New(db)
+
+	var steps []migrations.Step
+	switch action {
+	case "up":
+		steps, err = m.Up(ctx, n)
+	case "down":
+		steps, err = m.Down(ctx, n)
+	case "goto":
+		steps, err = m.Goto(ctx, n)
+	case "force":
+		if err := m.Force(ctx, n); err != nil {
+			return err
+		}
+		return printJSON(envelope{"version": n})
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(envelope{"status": status})
+	}
+
+	// The migrations applied before a failing one stay applied, so they are printed anyway.
+	applied := make([]envelope, 0, len(steps))
+	for _, step := range steps {
+		applied = append(applied, envelope{
+			"version":   step.Version,
+			"name":      step.Name,
+			"direction": step.Direction,
+			"duration":  step.Duration.String(),
+		})
+	}
+	if err := printJSON(envelope{"applied": applied}); err != nil {
+		return err
+	}
+	return err
+}
+
+// migrateOnStart applies the pending migrations before the server starts, for -migrate-on-start.
+// Instances started at the same time wait for each other on the migration lock, so only the
+// first one migrates.
+func migrateOnStart(db *sql.DB, logger *jsonlog.Logger) error {
+	steps, err := migrations.New(db).Up(context.Background(), 0)
+	for _, step := range steps {
+		logger.PrintInfo("applied migration", map[string]string{
+			"version":  strconv.Itoa(step.Version),
+			"name":     step.Name,
+			"duration": step.Duration.String(),
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("migrating database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// pathParamRX matches gorilla/mux path variables, with an optional pattern, e.g. {id:[0-9]+}.
+var pathParamRX = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)(?::[^}]*)?\}`)
+
+// openAPIDocument generates an OpenAPI 3 document from the route table. Request and response
+// schemas are derived by reflection from the input types and output envelopes of each route.
+func (app *application) openAPIDocument(prefix string, table []route) envelope {
+	schemas := &schemaRegistry{schemas: make(map[string]interface{})}
+	paths := make(map[string]interface{})
+
+	// Unversioned routes override the servers of the document with the root of the server.
+	root := app.config.baseURL
+	if root == "" {
+		root = "/"
+	}
+
+	for _, rt := range table {
+		path := pathParamRX.ReplaceAllString(rt.path, "{$1}")
+
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+
+		item[strings.ToLower(rt.method)] = schemas.operation(rt)
+		if rt.unversioned {
+			item["servers"] = []interface{}{
+				map[string]interface{}{"url": root},
+			}
+		}
+	}
+
+	return envelope{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "ATLA API",
+			"version": "1.0.0",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": prefix},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+	}
+}
+
+// openAPIHandler serves the document generated by routes(). It is always JSON, whatever
+// representation was negotiated for the request.
+func (app *application) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, app.openapi, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// schemaRegistry collects the named schemas referenced by the operations of the document.
+type schemaRegistry struct {
+	schemas map[string]interface{}
+}
+
+// operation builds the OpenAPI operation object for a single route.
+func (s *schemaRegistry) operation(rt route) map[string]interface{} {
+	op := map[string]interface{}{
+		"summary":     rt.summary,
+		"operationId": operationID(rt.handler),
+	}
+
+	var params []interface{}
+	for _, m := range pathParamRX.FindAllStringSubmatch(rt.path, -1) {
+		params = append(params, map[string]interface{}{
+			"name":     m[1],
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "integer", "minimum": 1},
+		})
+	}
+	for _, q := range rt.query {
+		params = append(params, map[string]interface{}{
+			"name":        q.name,
+			"in":          "query",
+			"description": q.description,
+			"schema":      map[string]interface{}{"type": q.typ},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if rt.input != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": s.schemaFor(reflect.TypeOf(rt.input)),
+				},
+			},
+		}
+	}
+
+	status := rt.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	responses := map[string]interface{}{
+		strconv.Itoa(status): map[string]interface{}{
+			"description": http.StatusText(status),
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": s.envelopeSchema(rt.output),
+				},
+			},
+		},
+		"406": s.errorResponse(http.StatusNotAcceptable),
+		"500": s.errorResponse(http.StatusInternalServerError),
+	}
+	if rt.input != nil {
+		responses["400"] = s.errorResponse(http.StatusBadRequest)
+		responses["422"] = s.errorResponse(http.StatusUnprocessableEntity)
+	}
+	if rt.cache == cacheReads {
+		responses["304"] = map[string]interface{}{
+			"description": "Not Modified, the representation matches If-None-Match or If-Modified-Since",
+		}
+	}
+	if pathParamRX.MatchString(rt.path) {
+		responses["404"] = s.errorResponse(http.StatusNotFound)
+	}
+
+	if rt.permission != "" {
+		op["security"] = []interface{}{
+			map[string]interface{}{"bearerAuth": []interface{}{}},
+		}
+		op["description"] = fmt.Sprintf("Requires an activated user with the %q permission.", rt.permission)
+		op["x-required-permission"] = rt.permission
+		responses["401"] = s.errorResponse(http.StatusUnauthorized)
+		responses["403"] = s.errorResponse(http.StatusForbidden)
+	}
+
+	op["responses"] = responses
+	return op
+}
+
+// errorResponse describes the {"error": ...} envelope written by errorResponse(). The message is
+// either a string, or a map of field names to messages for failed validations.
+func (s *schemaRegistry) errorResponse(status int) map[string]interface{} {
+	if _, ok := s.schemas["Error"]; !ok {
+		s.schemas["Error"] = map[string]interface{}{
+			"type":     "object",
+			"required": []string{"error"},
+			"properties": map[string]interface{}{
+				"request_id": map[string]interface{}{"type": "string"},
+				"error": map[string]interface{}{
+					"oneOf": []interface{}{
+						map[string]interface{}{"type": "string"},
+						map[string]interface{}{
+							"type":                 "object",
+							"additionalProperties": map[string]interface{}{"type": "string"},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"description": http.StatusText(status),
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+			},
+		},
+	}
+}
+
+// envelopeSchema describes an envelope whose members have the types of the provided values.
+func (s *schemaRegistry) envelopeSchema(env envelope) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := make([]string, 0, len(env))
+
+	for k, v := range env {
+		properties[k] = s.schemaFor(reflect.TypeOf(v))
+		required = append(required, k)
+	}
+	sort.Strings(required)
+
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaFor returns the schema of a Go type. Named struct types are registered as components and
+// referenced, everything else is inlined. Pointer fields are nullable and optional, other fields
+// are required unless their json tag has omitempty.
+func (s *schemaRegistry) schemaFor(t reflect.Type) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{}
+	}
+
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		// Any JSON value.
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := s.schemaFor(t.Elem())
+		if _, isRef := schema["$ref"]; isRef {
+			return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8,
+		reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+
+		name := schemaName(t)
+		if _, ok := s.schemas[name]; !ok {
+			// Register a placeholder first so that recursive types terminate.
+			s.schemas[name] = map[string]interface{}{}
+			s.schemas[name] = s.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema builds an object schema from the exported fields of a struct, following the same
+// rules as encoding/json for field names, embedded structs and the "-" tag.
+func (s *schemaRegistry) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+
+			if f.Anonymous && name == "" {
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					walk(ft)
+					continue
+				}
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+
+			properties[name] = s.schemaFor(f.Type)
+			if f.Type.Kind() != reflect.Ptr && !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// schemaName turns a Go type name into a component name, e.g. createCharacterInput becomes
+// CreateCharacterInput.
+func schemaName(t reflect.Type) string {
+	r := []rune(t.Name())
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// operationID derives the operationId of a route from the name of its handler method, e.g.
+// "getCharacterHandler".
+func operationID(h http.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	name = name[strings.LastIndex(name, ".")+1:]
+	return strings.TrimSuffix(name, "-fm")
+}
+
+// validateRequest is the opt-in (-openapi-validate) middleware which rejects requests that don't
+// match the route's description in the OpenAPI document: malformed query parameters, a body
+// that isn't JSON, or a body that doesn't satisfy the request schema.
+func (app *application) validateRequest(rt route, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		errs := make(map[string]string)
+
+		qs := r.URL.Query()
+		for _, q := range rt.query {
+			value := qs.Get(q.name)
+			if value == "" {
+				continue
+			}
+			if err := checkPrimitive(q.typ, value); err != nil {
+				errs[q.name] = err.Error()
+			}
+		}
+
+		if rt.input != nil {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				app.unsupportedMediaTypeResponse(w, r)
+				return
+			}
+
+			maxBytes := int64(1_048_576)
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+			if err != nil {
+				app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBytes))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.UseNumber()
+
+			var value interface{}
+			if err := dec.Decode(&value); err != nil {
+				app.badRequestResponse(w, r, fmt.Errorf("body contains badly-formed JSON"))
+				return
+			}
+
+			schema := app.openAPIRequestSchema(rt)
+			app.validateSchema(schema, value, "", errs)
+		}
+
+		if len(errs) > 0 {
+			app.failedValidationResponse(w, r, errs)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// openAPIRequestSchema looks up the request body schema of a route in the served document.
+func (app *application) openAPIRequestSchema(rt route) map[string]interface{} {
+	paths := app.openapi["paths"].(map[string]interface{})
+	item := paths[pathParamRX.ReplaceAllString(rt.path, "{$1}")].(map[string]interface{})
+	op := item[strings.ToLower(rt.method)].(map[string]interface{})
+
+	body := op["requestBody"].(map[string]interface{})
+	content := body["content"].(map[string]interface{})
+	return content["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+}
+
+// resolveSchema follows a local "#/components/schemas/..." reference.
+func (app *application) resolveSchema(schema map[string]interface{}) map[string]interface{} {
+	ref, ok := schema["$ref"].(string)
+	if !ok {
+		return schema
+	}
+
+	components := app.openapi["components"].(map[string]interface{})
+	schemas := components["schemas"].(map[string]interface{})
+	resolved, _ := schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{})
+	return resolved
+}
+
+// validateSchema checks a decoded JSON value against the subset of JSON Schema used by our
+// generated document, recording problems in errs keyed by the dotted path of the field.
+func (app *application) validateSchema(schema map[string]interface{}, value interface{}, path string,
+	errs map[string]string) {
+	schema = app.resolveSchema(schema)
+	key := path
+	if key == "" {
+		key = "body"
+	}
+
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); !nullable && len(schema) > 0 {
+			errs[key] = "must not be null"
+		}
+		return
+	}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			app.validateSchema(sub.(map[string]interface{}), value, path, errs)
+		}
+		return
+	}
+
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		for _, sub := range oneOf {
+			subErrs := make(map[string]string)
+			app.validateSchema(sub.(map[string]interface{}), value, path, subErrs)
+			if len(subErrs) == 0 {
+				return
+			}
+		}
+		errs[key] = "does not match any of the allowed types"
+		return
+	}
+
+	typ, _ := schema["type"].(string)
+	switch typ {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			errs[key] = "must be an object"
+			return
+		}
+
+		required, _ := schema["required"].([]string)
+		for _, name := range required {
+			if _, ok := obj[name]; !ok {
+				errs[joinPath(path, name)] = "must be provided"
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, v := range obj {
+			sub, ok := properties[name].(map[string]interface{})
+			if !ok {
+				switch additional := schema["additionalProperties"].(type) {
+				case bool:
+					if !additional {
+						errs[joinPath(path, name)] = "unknown field"
+					}
+				case map[string]interface{}:
+					app.validateSchema(additional, v, joinPath(path, name), errs)
+				}
+				continue
+			}
+			app.validateSchema(sub, v, joinPath(path, name), errs)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			errs[key] = "must be an array"
+			return
+		}
+		itemSchema, _ := schema["items"].(map[string]interface{})
+		for i, item := range items {
+			app.validateSchema(itemSchema, item, joinPath(path, strconv.Itoa(i)), errs)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			errs[key] = "must be a string"
+			return
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				errs[key] = "must be an RFC 3339 date-time"
+			}
+		}
+	case "integer", "number", "boolean":
+		var err error
+		switch v := value.(type) {
+		case json.Number:
+			err = checkPrimitive(typ, v.String())
+		case bool:
+			err = checkPrimitive(typ, strconv.FormatBool(v))
+		default:
+			err = fmt.Errorf("must be of type %s", typ)
+		}
+		if err != nil {
+			errs[key] = err.Error()
+		}
+	}
+}
+
+// checkPrimitive verifies that the textual value can be parsed as the OpenAPI primitive type.
+func checkPrimitive(typ, value string) error {
+	var err error
+	switch typ {
+	case "integer":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "number":
+		_, err = strconv.ParseFloat(value, 64)
+	case "boolean":
+		_, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		return fmt.Errorf("must be of type %s", typ)
+	}
+	return nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
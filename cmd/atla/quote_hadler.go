@@ -11,10 +11,18 @@ import (
 	"github.com/justverena/ATLA/pkg/atla/validator"
 )
 
+// createQuoteInput is the request body accepted by createQuoteHandler.
+type createQuoteInput struct {
+	Quote string `json:"quote"`
+}
+
+// updateQuoteInput is the request body accepted by updateQuoteHandler.
+type updateQuoteInput struct {
+	Quote *string `json:"quote"`
+}
+
 func (app *application) createQuoteHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Quote string `json:"quote"`
-	}
+	var input createQuoteInput
 
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -27,13 +35,13 @@ func (app *application) createQuoteHandler(w http.ResponseWriter, r *http.Reques
 		Quote: input.Quote,
 	}
 
-	err = app.models.Quotes.Insert(quote)
+	err = app.models.Quotes.Insert(r.Context(), quote)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusCreated, envelope{"quote": quote}, nil)
+	app.render(w, r, http.StatusCreated, envelope{"quote": app.quoteResource(r, quote)}, nil)
 }
 
 func (app *application) getQuoteList(w http.ResponseWriter, r *http.Request) {
@@ -58,13 +66,18 @@ func (app *application) getQuoteList(w http.ResponseWriter, r *http.Request) {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	quotes, metadata, err := app.models.Quotes.GetAll(input.Quote, input.Filters)
+	quotes, metadata, err := app.models.Quotes.GetAll(r.Context(), input.Quote, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"quotes": quotes, "metadata": metadata}, nil)
+	fingerprint := listFingerprint(quotes, (*model.Quote).Stamp)
+	if app.listNotModified(w, r, fingerprint, metadata.TotalRecords) {
+		return
+	}
+
+	app.render(w, r, http.StatusOK, envelope{"quotes": app.quoteResources(r, quotes), "metadata": app.listMetadata(r, "/quotes", metadata)}, nil)
 }
 
 func (app *application) getQuoteHandler(w http.ResponseWriter, r *http.Request) {
@@ -74,7 +87,7 @@ func (app *application) getQuoteHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	quote, err := app.models.Quotes.Get(id)
+	quote, err := app.models.Quotes.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -85,7 +98,11 @@ func (app *application) getQuoteHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"quote": quote}, nil)
+	if app.notModified(w, r, quote.UpdatedAt, quote.ID) {
+		return
+	}
+
+	app.render(w, r, http.StatusOK, envelope{"quote": app.quoteResource(r, quote)}, nil)
 }
 
 func (app *application) updateQuoteHandler(w http.ResponseWriter, r *http.Request) {
@@ -95,7 +112,7 @@ func (app *application) updateQuoteHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	quote, err := app.models.Quotes.Get(id)
+	quote, err := app.models.Quotes.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -106,9 +123,7 @@ func (app *application) updateQuoteHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	var input struct {
-		Quote *string `json:"quote"`
-	}
+	var input updateQuoteInput
 
 	err = app.readJSON(w, r, &input)
 	if err != nil {
@@ -125,7 +140,7 @@ func (app *application) updateQuoteHandler(w http.ResponseWriter, r *http.Reques
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	err = app.models.Quotes.Update(quote)
+	err = app.models.Quotes.Update(r.Context(), quote)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -136,7 +151,7 @@ func (app *application) updateQuoteHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"quote": quote}, nil)
+	app.render(w, r, http.StatusOK, envelope{"quote": app.quoteResource(r, quote)}, nil)
 }
 
 func (app *application) deleteQuoteHandler(w http.ResponseWriter, r *http.Request) {
@@ -146,7 +161,7 @@ func (app *application) deleteQuoteHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Quotes.Delete(id)
+	err = app.models.Quotes.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -157,7 +172,7 @@ func (app *application) deleteQuoteHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"message": "success"}, nil)
+	app.render(w, r, http.StatusOK, envelope{"message": "success"}, nil)
 }
 
 func (app *application) getCharacterQuotesList(w http.ResponseWriter, r *http.Request) {
@@ -168,20 +183,22 @@ func (app *application) getCharacterQuotesList(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	character, err := app.models.Characters.Get(characterID)
+	character, err := app.models.Characters.Get(r.Context(), characterID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	quotes, err := app.models.Quotes.GetQuotesByCharacterID(characterID)
+	quotes, err := app.models.Quotes.GetQuotesByCharacterID(r.Context(), characterID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"character": character}, nil)
-
-	app.writeJSON(w, http.StatusOK, envelope{"quotes": quotes}, nil)
+	fingerprint := listFingerprint(quotes, (*model.Quote).Stamp)
+	if app.listNotModified(w, r, character.ID, character.UpdatedAt.Unix(), fingerprint) {
+		return
+	}
 
+	app.render(w, r, http.StatusOK, envelope{"character": app.characterResource(r, character), "quotes": app.quoteResources(r, quotes)}, nil)
 }
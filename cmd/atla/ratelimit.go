@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route groups with their own rate limits. Every request is counted against groupDefault (per
+// IP) and, once authenticated, groupUser (per user). Routes can add a further limit with the
+// limit field of their route description.
+const (
+	groupDefault = "default"
+	groupAuth    = "auth"
+	groupUser    = "user"
+)
+
+// limit is the configuration of one token bucket: it refills at rps tokens per second up to
+// burst tokens.
+type limit struct {
+	rps   float64
+	burst int
+}
+
+// bucket is the state of a token bucket for one client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// minIdle is the shortest time a bucket is kept after the last request of its client.
+const minIdle = 3 * time.Minute
+
+// rateLimiter holds a token bucket per client key (an IP address or a user ID).
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   limit
+	buckets map[string]*bucket
+	done    chan struct{}
+}
+
+// newRateLimiter returns a rateLimiter and starts a background goroutine which removes the
+// buckets of clients that haven't been seen for a while, so that memory doesn't grow with
+// every distinct IP address that ever made a request. The goroutine runs until stop is called.
+func newRateLimiter(l limit) *rateLimiter {
+	rl := &rateLimiter{
+		limit:   l,
+		buckets: make(map[string]*bucket),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				rl.cleanup(now)
+			case <-rl.done:
+				return
+			}
+		}
+	}()
+
+	return rl
+}
+
+// stop ends the cleanup goroutine of the limiter.
+func (rl *rateLimiter) stop() {
+	close(rl.done)
+}
+
+// allow takes a token from the bucket of key. It reports whether the request is allowed, the
+// number of tokens left, and how long the client has to wait until the next token is available.
+func (rl *rateLimiter) allow(key string, now time.Time) (bool, int, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rl.limit.burst), last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(rl.limit.burst), b.tokens+now.Sub(b.last).Seconds()*rl.limit.rps)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rl.limit.rps * float64(time.Second))
+		return false, 0, wait
+	}
+
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// setLimit changes the limit of every client. Buckets above the new burst are cut down on their
+// next request.
+func (rl *rateLimiter) setLimit(l limit) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.limit = l
+}
+
+// burst returns the size of the buckets.
+func (rl *rateLimiter) burst() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.limit.burst
+}
+
+// reset returns how long it takes for the bucket of key to be full again.
+func (rl *rateLimiter) reset(key string) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		return 0
+	}
+	missing := float64(rl.limit.burst) - b.tokens
+	return time.Duration(missing / rl.limit.rps * float64(time.Second))
+}
+
+// cleanup removes the buckets which haven't been used for minIdle, or for as long as an empty
+// bucket takes to refill if that is longer. A removed bucket is full again on the next request,
+// so a client can't win tokens by pausing.
+func (rl *rateLimiter) cleanup(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	refill := time.Duration(float64(rl.limit.burst) / rl.limit.rps * float64(time.Second))
+	idle := max(minIdle, refill)
+
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) > idle {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// newRateLimiters creates a limiter for every configured route group.
+func newRateLimiters(groups map[string]limit) map[string]*rateLimiter {
+	limiters := make(map[string]*rateLimiter, len(groups))
+	for name, l := range groups {
+		limiters[name] = newRateLimiter(l)
+	}
+	return limiters
+}
+
+// stopRateLimiters ends the cleanup goroutines of the rate limiters.
+func (app *application) stopRateLimiters() {
+	for _, rl := range app.limiters {
+		rl.stop()
+	}
+}
+
+// limiterConfig returns the current rate limiter settings.
+func (app *application) limiterConfig() limiterConfig {
+	app.live.RLock()
+	defer app.live.RUnlock()
+	return app.config.limiter
+}
+
+// rateLimit returns a middleware which limits the requests of each client in group. The client
+// is identified by key; requests for which key returns "" are not limited.
+func (app *application) rateLimit(group string, key func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl, ok := app.limiters[group]
+		if !app.limiterConfig().enabled || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		k := key(r)
+		if k == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, remaining, retryAfter := rl.allow(group+":"+k, time.Now())
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(rl.burst()))
+		h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(rl.reset(group+":"+k).Seconds()))))
+
+		if !allowed {
+			h.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitIP limits requests in group by client IP address.
+func (app *application) rateLimitIP(group string, next http.Handler) http.Handler {
+	return app.rateLimit(group, app.clientIP, next)
+}
+
+// rateLimitUser limits requests by authenticated user. It has to run after authenticate, and
+// leaves anonymous requests to the per-IP limits.
+func (app *application) rateLimitUser(next http.Handler) http.Handler {
+	return app.rateLimit(groupUser, func(r *http.Request) string {
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			return ""
+		}
+		return strconv.FormatInt(user.ID, 10)
+	}, next)
+}
+
+// clientIP returns the IP address of the client. X-Forwarded-For is only trusted when the
+// request comes from one of the -limiter-trusted-proxies, in which case the address list is
+// walked from the right and the first address which isn't a trusted proxy is the client.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !app.isTrustedProxy(host) {
+		return host
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		if !app.isTrustedProxy(ip) {
+			return ip
+		}
+		host = ip
+	}
+
+	return host
+}
+
+func (app *application) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, network := range app.limiterConfig().trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and CIDR ranges.
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", s)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
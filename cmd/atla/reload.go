@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// isReloadable reports whether a setting takes effect on SIGHUP. The others need a restart.
+func isReloadable(name string) bool {
+	return name == "log-level" || strings.HasPrefix(name, "limiter-") || strings.HasPrefix(name, "cors-")
+}
+
+// handleReloads reloads the configuration and, when serving HTTPS, the certificate on every
+// SIGHUP. certs is nil without TLS.
+func (app *application) handleReloads(certs *certReloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		app.reloadConfig()
+
+		if certs == nil {
+			continue
+		}
+		// New connections get the new certificate, established ones aren't dropped.
+		if err := certs.reload(); err != nil {
+			app.logger.PrintError(err, nil)
+			continue
+		}
+		app.logger.PrintInfo("reloaded TLS certificate", map[string]string{
+			"cert": certs.certFile,
+		})
+	}
+}
+
+// reloadConfig loads the configuration again, from the same flags, environment and file as at
+// startup, and applies the log level, the rate limits and the CORS settings. An invalid
+// configuration is logged and the current one is kept. Changes to settings that need a restart
+// are logged too.
+func (app *application) reloadConfig() {
+	cfg, settings, err := loadConfig("atla", os.Args[1:], os.LookupEnv)
+	var problems configErrors
+	switch {
+	case errors.As(err, &problems):
+		app.logger.PrintError(errors.New("invalid configuration, keeping the current one"), problems)
+		return
+	case err != nil:
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	started := make(map[string]string, len(app.settings))
+	for _, s := range app.settings {
+		started[s.Name] = s.Value
+	}
+	var restart []string
+	for _, s := range settings {
+		if !isReloadable(s.Name) && started[s.Name] != s.Value {
+			restart = append(restart, s.Name)
+		}
+	}
+	sort.Strings(restart)
+
+	app.live.Lock()
+	app.config.limiter = cfg.limiter
+	app.config.cors = cfg.cors
+	app.live.Unlock()
+
+	for group, rl := range app.limiters {
+		rl.setLimit(cfg.limiter.groups[group])
+	}
+
+	properties := map[string]string{
+		"log_level": strings.ToLower(cfg.logLevel.String()),
+	}
+	if len(restart) > 0 {
+		properties["restart_required"] = strings.Join(restart, ",")
+	}
+
+	// Log the reload at the more verbose of the old and the new level, so that lowering the
+	// level to error doesn't hide it.
+	if cfg.logLevel > app.logger.Level() {
+		app.logger.PrintInfo("reloaded configuration", properties)
+		app.logger.SetLevel(cfg.logLevel)
+	} else {
+		app.logger.SetLevel(cfg.logLevel)
+		app.logger.PrintInfo("reloaded configuration", properties)
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errNotAcceptable is returned by negotiateFormat when none of the representations the client
+// is willing to accept can be produced.
+var errNotAcceptable = errors.New("not acceptable")
+
+// format describes a single representation that the API is able to render an envelope in.
+type format struct {
+	name        string
+	contentType string
+	encode      func(w http.ResponseWriter, data envelope) ([]byte, error)
+}
+
+// formats lists every supported representation. The first entry is the default that is used
+// when the client does not express a preference.
+var formats = []format{
+	{name: "json", contentType: "application/json", encode: encodeJSON},
+	{name: "csv", contentType: "text/csv", encode: encodeCSV},
+	{name: "ndjson", contentType: "application/x-ndjson", encode: encodeNDJSON},
+	{name: "xml", contentType: "application/xml", encode: encodeXML},
+}
+
+// formatAliases maps additional media types onto the canonical format names above.
+var formatAliases = map[string]string{
+	"application/json":     "json",
+	"text/json":            "json",
+	"text/csv":             "csv",
+	"application/csv":      "csv",
+	"application/x-ndjson": "ndjson",
+	"application/ndjson":   "ndjson",
+	"application/jsonl":    "ndjson",
+	"application/xml":      "xml",
+	"text/xml":             "xml",
+}
+
+const formatContextKey = contextKey("format")
+
+// formatByName returns the format with the provided name, and false if it is unknown.
+func formatByName(name string) (format, bool) {
+	for _, f := range formats {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return format{}, false
+}
+
+// negotiateFormat picks the representation for the response. A "format" query string parameter
+// always wins over the Accept header. Otherwise the Accept header is parsed and the acceptable
+// media type with the highest quality value is chosen, ties being broken by the order of the
+// formats slice.
+func negotiateFormat(r *http.Request) (format, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		f, ok := formatByName(strings.ToLower(name))
+		if !ok {
+			return format{}, errNotAcceptable
+		}
+		return f, nil
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return formats[0], nil
+	}
+
+	best, bestQ := -1, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		for i, f := range formats {
+			if !mediaTypeMatches(mediaType, f) {
+				continue
+			}
+			if q > bestQ || (q == bestQ && i < best) {
+				best, bestQ = i, q
+			}
+		}
+	}
+
+	if best < 0 {
+		return format{}, errNotAcceptable
+	}
+	return formats[best], nil
+}
+
+// mediaTypeMatches reports whether the media range from an Accept header covers format f.
+func mediaTypeMatches(mediaType string, f format) bool {
+	switch {
+	case mediaType == "*/*":
+		return true
+	case strings.HasSuffix(mediaType, "/*"):
+		return strings.HasPrefix(f.contentType, strings.TrimSuffix(mediaType, "*"))
+	default:
+		return formatAliases[mediaType] == f.name
+	}
+}
+
+// negotiate resolves the response representation once, before any handler runs, so that a
+// request which can't be answered in an acceptable format is rejected with 406 Not Acceptable
+// before it has any side effects. The chosen format is stored in the request context for render.
+func (app *application) negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+
+		f, err := negotiateFormat(r)
+		if err != nil {
+			app.notAcceptableResponse(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), formatContextKey, f)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// contextGetFormat returns the format stored by negotiate, falling back to JSON for requests that
+// didn't pass through the middleware.
+func (app *application) contextGetFormat(r *http.Request) format {
+	f, ok := r.Context().Value(formatContextKey).(format)
+	if !ok {
+		return formats[0]
+	}
+	return f
+}
+
+// render is the single place responses are written from. It encodes the envelope in the format
+// negotiated for the request and writes it along with the provided status and headers.
+func (app *application) render(w http.ResponseWriter, r *http.Request, status int, data envelope,
+	headers http.Header) error {
+	if app.contextGetVersion(r) == "v2" {
+		var err error
+		data, err = v2Envelope(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	f := app.contextGetFormat(r)
+	if f.name == "json" {
+		return app.writeJSON(w, status, data, headers)
+	}
+
+	body, err := f.encode(w, data)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", f.contentType+"; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		app.logger.PrintError(err, nil)
+		return err
+	}
+
+	return nil
+}
+
+// encodeJSON is only used through writeJSON, it exists so that the formats table is complete.
+func encodeJSON(_ http.ResponseWriter, data envelope) ([]byte, error) {
+	js, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(js, '\n'), nil
+}
+
+// encodeCSV writes the records of the envelope as CSV rows. Nested objects are flattened into
+// dotted column names (e.g. "metadata.page_size"), and the header row holds the union of the
+// columns of every record in the order they were first seen.
+func encodeCSV(w http.ResponseWriter, data envelope) ([]byte, error) {
+	records, extra, err := envelopeRecords(data)
+	if err != nil {
+		return nil, err
+	}
+	setExtraHeaders(w, extra)
+
+	var columns []string
+	seen := make(map[string]bool)
+	rows := make([]map[string]string, 0, len(records))
+
+	for _, record := range records {
+		row := make(map[string]string)
+		var keys []string
+		flatten("", record, row, &keys)
+
+		for _, k := range keys {
+			if !seen[k] {
+				seen[k] = true
+				columns = append(columns, k)
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+
+	if err := cw.Write(columns); err != nil {
+		return nil, err
+	}
+	line := make([]string, len(columns))
+	for _, row := range rows {
+		for i, c := range columns {
+			line[i] = row[c]
+		}
+		if err := cw.Write(line); err != nil {
+			return nil, err
+		}
+	}
+
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// encodeNDJSON writes each record of the envelope as one compact JSON document per line.
+func encodeNDJSON(w http.ResponseWriter, data envelope) ([]byte, error) {
+	records, extra, err := envelopeRecords(data)
+	if err != nil {
+		return nil, err
+	}
+	setExtraHeaders(w, extra)
+
+	var buf bytes.Buffer
+	for _, record := range records {
+		js, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(js)
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encodeXML writes the whole envelope as an XML document under a <response> root element. Array
+// elements are written as repeated <item> children of the element named after their key.
+func encodeXML(_ http.ResponseWriter, data envelope) ([]byte, error) {
+	tree, err := toOrderedTree(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "\t")
+	if err := writeXMLElement(enc, "response", tree); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func writeXMLElement(enc *xml.Encoder, name string, value interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: xmlName(name)}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case *orderedObject:
+		for _, k := range v.keys {
+			if err := writeXMLElement(enc, k, v.values[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := writeXMLElement(enc, "item", item); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := enc.EncodeToken(xml.CharData(scalarString(v))); err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+// xmlName turns a JSON key into a valid XML element name by replacing any disallowed characters.
+func xmlName(key string) string {
+	var b strings.Builder
+	for i, c := range key {
+		switch {
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			b.WriteRune(c)
+		case i > 0 && (c == '-' || c == '.' || c >= '0' && c <= '9'):
+			b.WriteRune(c)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// envelopeRecords extracts the rows for the tabular formats from an envelope. If the envelope
+// holds an array (e.g. "characters" in a list response) its elements are the records, and the
+// remaining members (such as "metadata") are returned separately. An envelope wrapping a single
+// object (e.g. "character", or "data" in v2) produces that object as the only record.
+func envelopeRecords(data envelope) ([]interface{}, map[string]interface{}, error) {
+	tree, err := toOrderedTree(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj := tree.(*orderedObject)
+
+	// A v2 document always holds its resources under "data": an object, a list, or null for
+	// responses without a resource, such as deletes and errors. Those are represented by their
+	// errors, or else by their meta.
+	if isV2Document(obj) {
+		extra := map[string]interface{}{"meta": obj.values["meta"]}
+		switch inner := obj.values["data"].(type) {
+		case *orderedObject:
+			return []interface{}{inner}, extra, nil
+		case []interface{}:
+			return inner, extra, nil
+		case nil:
+			if errs, ok := obj.values["errors"].([]interface{}); ok && len(errs) > 0 {
+				return errs, extra, nil
+			}
+			return []interface{}{obj.values["meta"]}, nil, nil
+		default:
+			return []interface{}{inner}, extra, nil
+		}
+	}
+
+	for _, k := range obj.keys {
+		items, ok := obj.values[k].([]interface{})
+		if !ok {
+			continue
+		}
+
+		extra := make(map[string]interface{})
+		for _, other := range obj.keys {
+			if other != k {
+				extra[other] = obj.values[other]
+			}
+		}
+		return items, extra, nil
+	}
+
+	if len(obj.keys) == 1 {
+		if inner, ok := obj.values[obj.keys[0]].(*orderedObject); ok {
+			return []interface{}{inner}, nil, nil
+		}
+	}
+
+	return []interface{}{obj}, nil, nil
+}
+
+// isV2Document reports whether obj is an envelope built by v2Envelope.
+func isV2Document(obj *orderedObject) bool {
+	if len(obj.keys) != 3 {
+		return false
+	}
+	for _, k := range []string{"data", "meta", "errors"} {
+		if _, ok := obj.values[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// setExtraHeaders exposes the envelope members that don't fit into a tabular body (for example
+// pagination metadata) as compact JSON in X-<Key> response headers.
+func setExtraHeaders(w http.ResponseWriter, extra map[string]interface{}) {
+	for k, v := range extra {
+		js, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		w.Header().Set("X-"+http.CanonicalHeaderKey(strings.ReplaceAll(k, "_", "-")), string(js))
+	}
+}
+
+// flatten walks a decoded JSON value and writes its scalar leaves into row, keyed by their dotted
+// path. Arrays of scalars are joined with ";", arrays of objects are indexed ("items.0.id"). The
+// keys slice receives the column names in document order.
+func flatten(prefix string, value interface{}, row map[string]string, keys *[]string) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+
+	switch v := value.(type) {
+	case *orderedObject:
+		for _, k := range v.keys {
+			flatten(join(k), v.values[k], row, keys)
+		}
+	case []interface{}:
+		scalars := make([]string, 0, len(v))
+		for i, item := range v {
+			switch item.(type) {
+			case *orderedObject, []interface{}:
+				flatten(join(strconv.Itoa(i)), item, row, keys)
+			default:
+				scalars = append(scalars, scalarString(item))
+			}
+		}
+		if len(scalars) > 0 || len(v) == 0 {
+			setCell(prefix, strings.Join(scalars, ";"), row, keys)
+		}
+	default:
+		setCell(prefix, scalarString(v), row, keys)
+	}
+}
+
+func setCell(key, value string, row map[string]string, keys *[]string) {
+	if key == "" {
+		key = "value"
+	}
+	if _, exists := row[key]; !exists {
+		*keys = append(*keys, key)
+	}
+	row[key] = value
+}
+
+func scalarString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// orderedObject is a decoded JSON object which remembers the order of its keys, so that the
+// struct field order of our models carries through to CSV columns and XML elements.
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// toOrderedTree round-trips v through encoding/json, so that struct tags and custom marshalers
+// are honored exactly as for JSON responses, and decodes the result into orderedObject,
+// []interface{} and scalar values.
+func toOrderedTree(v interface{}) (interface{}, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	return decodeOrdered(dec)
+}
+
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+
+	switch delim {
+	case '{':
+		obj := &orderedObject{values: make(map[string]interface{})}
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := keyTok.(string)
+
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			obj.set(key, value)
+		}
+		_, err := dec.Token()
+		return obj, err
+	case '[':
+		items := []interface{}{}
+		for dec.More() {
+			item, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		_, err := dec.Token()
+		return items, err
+	default:
+		return nil, fmt.Errorf("unexpected JSON delimiter %q", delim)
+	}
+}
+
+// MarshalJSON lets an orderedObject be re-encoded with its original key order.
+func (o *orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value, err := json.Marshal(o.values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// supportedContentTypes lists the media types of every format, for use in error messages.
+func supportedContentTypes() string {
+	types := make([]string, len(formats))
+	for i, f := range formats {
+		types[i] = f.contentType
+	}
+	return strings.Join(types, ", ")
+}
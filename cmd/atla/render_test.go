@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+		want   string
+	}{
+		{name: "no preference", want: "json"},
+		{name: "json", accept: "application/json", want: "json"},
+		{name: "alias", accept: "text/xml", want: "xml"},
+		{name: "any", accept: "*/*", want: "json"},
+		{name: "wildcard subtype", accept: "text/*", want: "csv"},
+		{name: "quality", accept: "application/json;q=0.5, text/csv", want: "csv"},
+		{name: "tie keeps the format order", accept: "application/xml, application/x-ndjson", want: "ndjson"},
+		{name: "unsupported types are ignored", accept: "image/png, application/xml;q=0.1", want: "xml"},
+		{name: "query wins", query: "format=CSV", accept: "application/json", want: "csv"},
+
+		{name: "unsupported", accept: "image/png"},
+		{name: "refused", accept: "application/json;q=0"},
+		{name: "unknown query format", query: "format=yaml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/characters?"+tt.query, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+
+			f, err := negotiateFormat(r)
+			switch {
+			case tt.want == "" && !errors.Is(err, errNotAcceptable):
+				t.Fatalf("got %s, %v, want errNotAcceptable", f.name, err)
+			case tt.want != "" && err != nil:
+				t.Fatal(err)
+			case f.name != tt.want:
+				t.Errorf("got %s, want %s", f.name, tt.want)
+			}
+		})
+	}
+}
+
+type testDetails struct {
+	Nation string `json:"nation"`
+}
+
+type testCharacter struct {
+	ID      int64       `json:"id"`
+	Name    string      `json:"name"`
+	Details testDetails `json:"details"`
+}
+
+var (
+	testSingle = envelope{"character": testCharacter{1, "Aang", testDetails{"Air Nomads"}}}
+	testList   = envelope{
+		"characters": []testCharacter{
+			{1, "Aang", testDetails{"Air Nomads"}},
+			{2, "Katara, of the Southern Water Tribe", testDetails{"Water Tribe"}},
+		},
+		"metadata": map[string]int{"total_records": 2},
+	}
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name        string
+		accept      string
+		data        envelope
+		status      int
+		contentType string
+		body        string
+		headers     map[string]string
+	}{
+		{
+			name:        "json",
+			accept:      "application/json",
+			data:        testSingle,
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        "{\n\t\"character\": {\n\t\t\"id\": 1,\n\t\t\"name\": \"Aang\",\n\t\t\"details\": {\n\t\t\t\"nation\": \"Air Nomads\"\n\t\t}\n\t}\n}\n",
+		},
+		{
+			name:        "csv object",
+			accept:      "text/csv",
+			data:        testSingle,
+			status:      http.StatusOK,
+			contentType: "text/csv; charset=utf-8",
+			body:        "id,name,details.nation\n1,Aang,Air Nomads\n",
+		},
+		{
+			name:        "csv list",
+			accept:      "text/csv",
+			data:        testList,
+			status:      http.StatusOK,
+			contentType: "text/csv; charset=utf-8",
+			body:        "id,name,details.nation\n1,Aang,Air Nomads\n2,\"Katara, of the Southern Water Tribe\",Water Tribe\n",
+			headers:     map[string]string{"X-Metadata": `{"total_records":2}`},
+		},
+		{
+			name:        "ndjson object",
+			accept:      "application/x-ndjson",
+			data:        testSingle,
+			status:      http.StatusOK,
+			contentType: "application/x-ndjson; charset=utf-8",
+			body:        `{"id":1,"name":"Aang","details":{"nation":"Air Nomads"}}` + "\n",
+		},
+		{
+			name:        "ndjson list",
+			accept:      "application/x-ndjson",
+			data:        testList,
+			status:      http.StatusOK,
+			contentType: "application/x-ndjson; charset=utf-8",
+			body: `{"id":1,"name":"Aang","details":{"nation":"Air Nomads"}}` + "\n" +
+				`{"id":2,"name":"Katara, of the Southern Water Tribe","details":{"nation":"Water Tribe"}}` + "\n",
+			headers: map[string]string{"X-Metadata": `{"total_records":2}`},
+		},
+		{
+			name:        "xml object",
+			accept:      "application/xml",
+			data:        testSingle,
+			status:      http.StatusOK,
+			contentType: "application/xml; charset=utf-8",
+			body: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				"<response>\n\t<character>\n\t\t<id>1</id>\n\t\t<name>Aang</name>\n\t\t<details>\n\t\t\t<nation>Air Nomads</nation>\n\t\t</details>\n\t</character>\n</response>\n",
+		},
+		{
+			name:        "xml list",
+			accept:      "application/xml",
+			data:        envelope{"characters": testList["characters"], "metadata": testList["metadata"]},
+			status:      http.StatusOK,
+			contentType: "application/xml; charset=utf-8",
+			body: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				"<response>\n\t<characters>\n" +
+				"\t\t<item>\n\t\t\t<id>1</id>\n\t\t\t<name>Aang</name>\n\t\t\t<details>\n\t\t\t\t<nation>Air Nomads</nation>\n\t\t\t</details>\n\t\t</item>\n" +
+				"\t\t<item>\n\t\t\t<id>2</id>\n\t\t\t<name>Katara, of the Southern Water Tribe</name>\n\t\t\t<details>\n\t\t\t\t<nation>Water Tribe</nation>\n\t\t\t</details>\n\t\t</item>\n" +
+				"\t</characters>\n\t<metadata>\n\t\t<total_records>2</total_records>\n\t</metadata>\n</response>\n",
+		},
+		{
+			name:        "not acceptable",
+			accept:      "image/png",
+			data:        testSingle,
+			status:      http.StatusNotAcceptable,
+			contentType: "application/json",
+			body:        "the requested representation is not supported, use one of: application/json, text/csv, application/x-ndjson, application/xml",
+		},
+	}
+
+	app := &application{}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := app.negotiate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := app.render(w, r, http.StatusOK, tt.data, nil); err != nil {
+					t.Fatal(err)
+				}
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/characters", nil)
+			r.Header.Set("Accept", tt.accept)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := rr.Header().Get("Vary"); got != "Accept" {
+				t.Errorf("Vary = %q, want Accept", got)
+			}
+			if tt.status == http.StatusOK && rr.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.body)
+			}
+			if tt.status != http.StatusOK && !strings.Contains(rr.Body.String(), tt.body) {
+				t.Errorf("body = %q, want it to contain %q", rr.Body.String(), tt.body)
+			}
+			for k, v := range tt.headers {
+				if got := rr.Header().Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderV2CSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    envelope
+		body    string
+		headers map[string]string
+	}{
+		{
+			name: "object",
+			data: testSingle,
+			body: "id,name,details.nation\n1,Aang,Air Nomads\n",
+		},
+		{
+			name:    "list",
+			data:    testList,
+			body:    "id,name,details.nation\n1,Aang,Air Nomads\n2,\"Katara, of the Southern Water Tribe\",Water Tribe\n",
+			headers: map[string]string{"X-Meta": `{"total_records":2}`},
+		},
+		{
+			name: "empty list",
+			data: envelope{"characters": []testCharacter{}, "metadata": map[string]int{"total_records": 0}},
+			body: "\n",
+		},
+		{
+			name: "null data",
+			data: envelope{"message": "character successfully deleted"},
+			body: "message\ncharacter successfully deleted\n",
+		},
+		{
+			name: "errors",
+			data: envelope{"error": map[string]string{"name": "must be provided"}},
+			body: "field,message\nname,must be provided\n",
+		},
+	}
+
+	app := &application{}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := app.negotiate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := app.render(w, app.contextSetVersion(r, "v2"), http.StatusOK, tt.data, nil); err != nil {
+					t.Fatal(err)
+				}
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v2/characters", nil)
+			r.Header.Set("Accept", "text/csv")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			if rr.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.body)
+			}
+			for k, v := range tt.headers {
+				if got := rr.Header().Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/justverena/ATLA/pkg/atla/model"
+)
+
+// maxRequestIDLength is the longest X-Request-ID accepted from clients or proxies.
+const maxRequestIDLength = 128
+
+// requestID makes sure that every request has an ID. An X-Request-ID set by the client or a
+// reverse proxy is kept if it looks sensible, otherwise a random one is generated. The ID is
+// stored in the request context, where the model layer can find it too, and echoed in the
+// X-Request-ID response header.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		r = r.WithContext(model.ContextWithRequestID(r.Context(), id))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID reports whether id is non-empty, not too long and only contains visible ASCII
+// characters, so that it can be written to logs and headers as it is.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns 16 random bytes, hex encoded.
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		// crypto/rand failing is extremely unlikely, fall back to a time-based ID.
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestInfo collects details about a request which are only known deeper in the middleware
+// chain (the route that matched and the authenticated user), so that logRequests can include
+// them in the access log.
+type requestInfo struct {
+	route string
+	user  *model.User
+}
+
+// logRequests writes one access log entry for every request once its response has been sent.
+func (app *application) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		info := &requestInfo{}
+		r = app.contextSetRequestInfo(r, info)
+
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		properties := map[string]string{
+			"request_id":     app.contextGetRequestID(r),
+			"request_method": r.Method,
+			"request_url":    r.URL.RequestURI(),
+			"route":          info.route,
+			"status":         strconv.Itoa(rec.status),
+			"bytes":          strconv.Itoa(rec.bytes),
+			"duration":       time.Since(start).String(),
+			"remote_ip":      app.clientIP(r),
+		}
+		if info.user != nil && !info.user.IsAnonymous() {
+			properties["user_id"] = strconv.FormatInt(info.user.ID, 10)
+		}
+
+		app.logger.PrintInfo("request", properties)
+	})
+}
+
+// responseRecorder wraps a http.ResponseWriter to record the status code and the number of body
+// bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying http.ResponseWriter.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -2,52 +2,247 @@ package main
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/justverena/ATLA/pkg/atla/leader"
+	"github.com/justverena/ATLA/pkg/atla/model"
 )
 
-func (app *application) routes() http.Handler {
-	r := mux.NewRouter()
-	r.NotFoundHandler = http.HandlerFunc(app.notFoundResponse)
+// route describes a single endpoint of the API. The same table drives the router below and the
+// OpenAPI document served at /api/v1/openapi.json, so the two can never drift apart.
+type route struct {
+	method     string
+	path       string
+	handler    http.HandlerFunc
+	summary    string
+	permission string       // permission code checked with requirePermissions, if any
+	status     int          // status code of a successful response, 200 if zero
+	input      interface{}  // request body type, nil if the endpoint doesn't take a body
+	output     envelope     // envelope members of a successful response and their types
+	query      []queryParam // query string parameters understood by the handler
+	limit      string       // additional rate limit group, e.g. groupAuth
+	cache      string       // cache policy for the Cache-Control header, e.g. cacheReads
+	v1Only     bool         // true if the route isn't served under /api/v2
+	// unversioned routes are served at their path as is, outside of /api/v1 and /api/v2.
+	unversioned bool
+}
 
-	r.MethodNotAllowedHandler = http.HandlerFunc(app.methodNotAllowedResponse)
+// queryParam documents a query string parameter. typ is an OpenAPI primitive type.
+type queryParam struct {
+	name        string
+	typ         string
+	description string
+}
 
-	character1 := r.PathPrefix("/api/v1").Subrouter()
+// listParams returns the pagination and sorting parameters shared by every list endpoint,
+// followed by the provided endpoint-specific filters.
+func listParams(filters ...queryParam) []queryParam {
+	return append(filters,
+		queryParam{"page", "integer", "page number, starting at 1"},
+		queryParam{"page_size", "integer", "number of records per page, at most 100"},
+		queryParam{"sort", "string", "field to sort by, prefix with - for descending order"},
+	)
+}
 
-	character1.HandleFunc("/characters/{id:[0-9]+}/episode", app.getCharacterEpisode).Methods("GET")
-	character1.HandleFunc("/characters/{id:[0-9]+}/quotes", app.getCharacterQuotesList).Methods("GET")
+// routeTable returns every API endpoint, relative to the /api/v1 (or /api/v2) prefix unless it is
+// unversioned. Routes are matched in the order they are listed.
+//
+// The metrics endpoints aren't listed: they are served on the admin listener when -metrics-addr
+// is set, and their documents are the expvar JSON and the Prometheus text format rather than
+// envelopes of the API.
+func (app *application) routeTable() []route {
+	return []route{
+		{method: "GET", path: "/openapi.json", handler: app.openAPIHandler,
+			summary: "OpenAPI description of this API", v1Only: true, cache: cacheStatic},
+
+		{method: "GET", path: "/characters/{id:[0-9]+}/episode", handler: app.getCharacterEpisode,
+			summary: "List the episodes a character appears in", cache: cacheReads,
+			output: envelope{"character": characterResource{}, "episode": []episodeResource{}}},
+		{method: "GET", path: "/characters/{id:[0-9]+}/quotes", handler: app.getCharacterQuotesList,
+			summary: "List the quotes of a character", cache: cacheReads,
+			output: envelope{"character": characterResource{}, "quotes": []quoteResource{}}},
+
+		{method: "GET", path: "/characters", handler: app.getCharacterList,
+			summary: "List characters", cache: cacheReads,
+			output: envelope{"characters": []characterResource{}, "metadata": listMetadata{}},
+			query: listParams(
+				queryParam{"name", "string", "exact name, case insensitive"},
+				queryParam{"age", "integer", "exact age"},
+			)},
+		{method: "POST", path: "/characters", handler: app.createCharacterHandler,
+			summary: "Create a character", status: http.StatusCreated,
+			input: createCharacterInput{}, output: envelope{"character": characterResource{}}},
+		{method: "GET", path: "/characters/{id:[0-9]+}", handler: app.getCharacterHandler,
+			summary: "Show a character", cache: cacheReads,
+			output: envelope{"character": characterResource{}}},
+		{method: "PUT", path: "/characters/{id:[0-9]+}", handler: app.updateCharacterHandler,
+			summary: "Update a character",
+			input:   updateCharacterInput{}, output: envelope{"character": characterResource{}}},
+		{method: "DELETE", path: "/characters/{id:[0-9]+}", handler: app.deleteCharacterHandler,
+			summary: "Delete a character", permission: "characters:write",
+			output: envelope{"message": ""}},
+
+		{method: "GET", path: "/episodes/{id:[0-9]+}/characters", handler: app.getEpisodeCharacters,
+			summary: "List the characters appearing in an episode", cache: cacheReads,
+			output: envelope{"episode": episodeResource{}, "characters": []characterResource{}}},
+
+		{method: "GET", path: "/episodes", handler: app.getEpisodeList,
+			summary: "List episodes", cache: cacheReads,
+			output: envelope{"episodes": []episodeResource{}, "metadata": listMetadata{}},
+			query: listParams(
+				queryParam{"title", "string", "part of the title, case insensitive"},
+			)},
+		{method: "POST", path: "/episodes", handler: app.createEpisodeHandler,
+			summary: "Create an episode", status: http.StatusCreated,
+			input: createEpisodeInput{}, output: envelope{"episodes": episodeResource{}}},
+		{method: "GET", path: "/episodes/{id:[0-9]+}", handler: app.getEpisodeHandler,
+			summary: "Show an episode", cache: cacheReads,
+			output: envelope{"episodes": episodeResource{}}},
+		{method: "PUT", path: "/episodes/{id:[0-9]+}", handler: app.updateEpisodeHandler,
+			summary: "Update an episode",
+			input:   updateEpisodeInput{}, output: envelope{"episodes": episodeResource{}}},
+		{method: "DELETE", path: "/episodes/{id:[0-9]+}", handler: app.deleteEpisodeHandler,
+			summary: "Delete an episode", permission: "episodes:write",
+			output: envelope{"message": ""}},
+
+		{method: "GET", path: "/quotes/{id:[0-9]+}/character", handler: app.getQuoteCharacter,
+			summary: "Show the character a quote belongs to", cache: cacheReads,
+			output: envelope{"quote": quoteResource{}, "character": characterResource{}}},
+
+		{method: "GET", path: "/quotes", handler: app.getQuoteList,
+			summary: "List quotes", cache: cacheReads,
+			output: envelope{"quotes": []quoteResource{}, "metadata": listMetadata{}},
+			query: listParams(
+				queryParam{"quote", "string", "part of the quote, case insensitive"},
+			)},
+		{method: "POST", path: "/quotes", handler: app.createQuoteHandler,
+			summary: "Create a quote", status: http.StatusCreated,
+			input: createQuoteInput{}, output: envelope{"quote": quoteResource{}}},
+		{method: "GET", path: "/quotes/{id:[0-9]+}", handler: app.getQuoteHandler,
+			summary: "Show a quote", cache: cacheReads,
+			output: envelope{"quote": quoteResource{}}},
+		{method: "PUT", path: "/quotes/{id:[0-9]+}", handler: app.updateQuoteHandler,
+			summary: "Update a quote",
+			input:   updateQuoteInput{}, output: envelope{"quote": quoteResource{}}},
+		{method: "DELETE", path: "/quotes/{id:[0-9]+}", handler: app.deleteQuoteHandler,
+			summary: "Delete a quote", permission: "quotes:write",
+			output: envelope{"message": ""}},
+
+		{method: "POST", path: "/users", handler: app.registerUserHandler,
+			summary: "Register a user", status: http.StatusCreated, limit: groupAuth,
+			input: registerUserInput{}, output: envelope{"user": registerUserResponse{}}},
+		{method: "PUT", path: "/users/activated", handler: app.activateUserHandler,
+			summary: "Activate a user with an activation token", limit: groupAuth,
+			input: activateUserInput{}, output: envelope{"user": model.User{}}},
+		{method: "POST", path: "/users/login", handler: app.createAuthenticationTokenHandler,
+			summary: "Create an authentication token", status: http.StatusCreated, limit: groupAuth,
+			input: createAuthenticationTokenInput{}, output: envelope{"authentication_token": model.Token{}}},
+
+		{method: "GET", path: "/jobs", handler: app.listJobsHandler,
+			summary: "List background jobs", permission: "jobs:read",
+			output: envelope{"jobs": []model.Job{}, "metadata": listMetadata{}},
+			query: listParams(
+				queryParam{"status", "string", "pending, running, succeeded or dead"},
+				queryParam{"kind", "string", "exact kind of job"},
+			)},
+		{method: "POST", path: "/jobs/{id:[0-9]+}/retry", handler: app.retryJobHandler,
+			summary: "Run a dead or pending job again straight away", permission: "jobs:write",
+			output: envelope{"job": model.Job{}}},
+		{method: "GET", path: "/schedules", handler: app.listSchedulesHandler,
+			summary: "List periodic jobs with the outcome of their last run", permission: "jobs:read",
+			output: envelope{"schedules": []scheduleStatus{}, "leadership": leader.Status{}}},
+
+		{method: "POST", path: "/batch", handler: app.batchHandler,
+			summary: "Run several requests at once, later ones can reference earlier results as $<n>.<field>",
+			input:   batchInput{}, output: envelope{"responses": []batchResponse{}}},
+
+		// Probes for the orchestrator. They live outside of the versioned API.
+		{method: "GET", path: "/v1/healthcheck", handler: app.healthcheckHandler, unversioned: true,
+			summary: "Liveness probe, with the version of the server and its leadership",
+			output:  envelope{"status": "", "system_info": map[string]string{}, "leadership": leader.Status{}}},
+		{method: "GET", path: "/readyz", handler: app.readyzHandler, unversioned: true,
+			summary: "Readiness probe, answers 503 with the same document when a check fails",
+			output:  envelope{"status": "", "checks": map[string]string{}}},
+	}
+}
 
-	character1.HandleFunc("/characters", app.getCharacterList).Methods("GET")
-	character1.HandleFunc("/characters", app.createCharacterHandler).Methods("POST")
-	character1.HandleFunc("/characters/{id:[0-9]+}", app.getCharacterHandler).Methods("GET")
-	character1.HandleFunc("/characters/{id:[0-9]+}", app.updateCharacterHandler).Methods("PUT")
-	character1.HandleFunc("/characters/{id:[0-9]+}", app.requirePermissions("characters:write", app.deleteCharacterHandler)).Methods("DELETE")
+func (app *application) routes() http.Handler {
+	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(app.notFoundResponse)
 
-	episode1 := r.PathPrefix("/api/v1").Subrouter()
+	r.MethodNotAllowedHandler = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	episode1.HandleFunc("/episodes/{id:[0-9]+}/characters", app.getEpisodeCharacters).Methods("GET")
+	app.router = r
+
+	table := app.routeTable()
+	app.openapi = app.openAPIDocument(app.config.baseURL+"/api/v1", table)
+
+	// v1 and v2 share their handlers, the differences in the response documents are applied by
+	// render() based on the version that versioned() found in the path.
+	v1 := r.PathPrefix(apiVersions["v1"]).Subrouter()
+	v2 := r.PathPrefix(apiVersions["v2"]).Subrouter()
+
+	for _, rt := range table {
+		if rt.unversioned {
+			r.HandleFunc(rt.path, app.routeHandler(rt)).Methods(rt.method)
+			continue
+		}
+		v1.HandleFunc(rt.path, app.routeHandler(rt)).Methods(rt.method)
+		if !rt.v1Only {
+			v2.HandleFunc(rt.path, app.routeHandler(rt)).Methods(rt.method)
+		}
+	}
+
+	// Without a separate admin listener, the metrics are served on the API port to users with
+	// the metrics:read permission only.
+	if app.config.metrics.addr == "" {
+		app.metricsRoutes(func(path string, h http.HandlerFunc) {
+			r.HandleFunc(path, app.recordRoute(path, app.requirePermissions("metrics:read", h))).Methods("GET")
+		})
+	}
+
+	// The per-IP limit is checked before authenticate, so that floods of requests with made up
+	// tokens don't reach the database, and the per-user limit right after it.
+	return app.requestID(app.logRequests(app.recordMetrics(app.recoverPanic(app.compress(app.versioned(app.enableCORS(app.negotiate(app.rateLimitIP(groupDefault, app.authenticate(app.rateLimitUser(r)))))))))))
+}
 
-	episode1.HandleFunc("/episodes", app.getEpisodeList).Methods("GET")
-	episode1.HandleFunc("/episodes", app.createEpisodeHandler).Methods("POST")
-	episode1.HandleFunc("/episodes/{id:[0-9]+}", app.getEpisodeHandler).Methods("GET")
-	episode1.HandleFunc("/episodes/{id:[0-9]+}", app.updateEpisodeHandler).Methods("PUT")
-	episode1.HandleFunc("/episodes/{id:[0-9]+}", app.requirePermissions("episodes:write", app.deleteEpisodeHandler)).Methods("DELETE")
+// routeHandler wraps the handler of a route with the middleware its description asks for.
+func (app *application) routeHandler(rt route) http.HandlerFunc {
+	h := app.recordRoute(rt.path, rt.handler)
 
-	quote1 := r.PathPrefix("/api/v1").Subrouter()
+	if rt.cache != "" {
+		h = app.cacheControl(rt.cache, h)
+	}
 
-	episode1.HandleFunc("/quotes/{id:[0-9]+}/character", app.getQuoteCharacter).Methods("GET")
+	// Validation runs inside the permission check, so that an unauthenticated client gets a 401
+	// rather than details about what the request body should look like.
+	if app.config.openapi.validate {
+		h = app.validateRequest(rt, h)
+	}
 
-	quote1.HandleFunc("/quotes", app.getQuoteList).Methods("GET")
-	quote1.HandleFunc("/quotes", app.createQuoteHandler).Methods("POST")
-	quote1.HandleFunc("/quotes/{id:[0-9]+}", app.getQuoteHandler).Methods("GET")
-	quote1.HandleFunc("/quotes/{id:[0-9]+}", app.updateQuoteHandler).Methods("PUT")
-	quote1.HandleFunc("/quotes/{id:[0-9]+}", app.requirePermissions("quotes:write", app.deleteQuoteHandler)).Methods("DELETE")
+	if rt.permission != "" {
+		h = app.requirePermissions(rt.permission, h)
+	}
 
-	users1 := r.PathPrefix("/api/v1").Subrouter()
+	if rt.limit != "" {
+		h = app.rateLimitIP(rt.limit, h).ServeHTTP
+	}
 
-	users1.HandleFunc("/users", app.registerUserHandler).Methods("POST")
-	users1.HandleFunc("/users/activated", app.activateUserHandler).Methods("PUT")
-	users1.HandleFunc("/users/login", app.createAuthenticationTokenHandler).Methods("POST")
+	return h
+}
 
-	return app.authenticate(r)
+// recordRoute stores the route template (e.g. /api/v1/characters/{id}) in the request info for
+// the access log and the metrics. Paths of versioned routes are given without the API prefix.
+// The first route wins, so that batch sub-requests are counted as part of the batch.
+func (app *application) recordRoute(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if info := app.contextGetRequestInfo(r); info != nil && info.route == "" {
+			info.route = path
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				info.route = app.apiPrefix(r) + path
+			}
+		}
+		next(w, r)
+	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/justverena/ATLA/pkg/atla/fixtures"
+	"github.com/justverena/ATLA/pkg/atla/model"
+	"github.com/justverena/ATLA/pkg/atla/validator"
+)
+
+// seedCommand implements "atla seed", which loads the canonical dataset, or the fixture files in
+// -fixtures, into the database. Everything runs in a single transaction, which -dry-run rolls
+// back after counting what would change.
+func seedCommand(args []string) error {
+	var dir, only string
+	var dryRun bool
+
+	cfg, _, err := loadConfig("atla seed", args, os.LookupEnv, func(fs *flag.FlagSet) {
+		fs.StringVar(&dir, "fixtures", "", "Directory of the fixture files (default: the canonical dataset built into atla)")
+		fs.StringVar(&only, "only", "", "Comma-separated resources to seed: "+strings.Join(fixtures.Resources, ", ")+" (default: all)")
+		fs.BoolVar(&dryRun, "dry-run", false, "Report what would change without committing it")
+	})
+	if err != nil {
+		return err
+	}
+
+	var resources []string
+	for _, resource := range strings.Split(only, ",") {
+		resource = strings.TrimSpace(resource)
+		if resource == "" {
+			continue
+		}
+		if !validator.In(resource, fixtures.Resources...) {
+			return fmt.Errorf("unknown resource %q, use one of: %s", resource, strings.Join(fixtures.Resources, ", "))
+		}
+		resources = append(resources, resource)
+	}
+
+	var fsys fs.FS = fixtures.Canonical
+	if dir != "" {
+		fsys = os.DirFS(dir)
+	}
+	data, err := fixtures.Load(fsys)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	summary, err := fixtures.Seed(ctx, model.NewModels(tx, cfg.db.timeouts), data, resources)
+	if err != nil {
+		return fmt.Errorf("nothing was seeded: %w", err)
+	}
+
+	if !dryRun {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return printJSON(envelope{"dry_run": dryRun, "summary": summary})
+}
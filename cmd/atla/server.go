@@ -23,9 +23,56 @@ func (app *application) serve() error {
 		WriteTimeout: 30 * time.Second,
 	}
 
-	// Create a shutdownError channel. We will use this to receive any errors returned
-	// by the graceful Shutdown() function.
-	shutdownError := make(chan error)
+	// Extra listeners which are started and shut down along with srv.
+	var aux []*http.Server
+
+	// When -metrics-addr is set, the metrics are served on their own listener, which is meant to
+	// be reachable from the monitoring network only and therefore needs no authentication.
+	if app.config.metrics.addr != "" {
+		adminMux := http.NewServeMux()
+		app.metricsRoutes(func(path string, h http.HandlerFunc) {
+			adminMux.HandleFunc(path, h)
+		})
+
+		aux = append(aux, app.startAuxServer("admin", app.config.metrics.addr, adminMux))
+	}
+
+	var certs *certReloader
+	if app.config.tls.enabled() {
+		certFile, keyFile, err := app.tlsFiles()
+		if err != nil {
+			return err
+		}
+
+		certs, err = newCertReloader(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = app.serverTLSConfig(certs)
+
+		if app.config.tls.redirectAddr != "" {
+			aux = append(aux, app.startAuxServer("redirect", app.config.tls.redirectAddr, http.HandlerFunc(app.redirectToHTTPS)))
+		}
+	}
+
+	// Reload the configuration, and the certificate after it has been renewed, on SIGHUP.
+	go app.handleReloads(certs)
+
+	// Run background jobs until the shutdown, which then waits for the running ones like for any
+	// other background task. The periodic jobs are only enqueued by the leader of the instances,
+	// so that they aren't enqueued once per instance.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	app.background("job workers", func() {
+		app.queue.Run(jobsCtx)
+	})
+	app.background("leader election", func() {
+		app.elector.Run(jobsCtx, app.scheduler.Run)
+	})
+
+	// Create a shutdownError channel. We will use this to receive the outcome of the graceful
+	// shutdown. It is buffered, so that the shutdown goroutine never blocks on it.
+	shutdownError := make(chan error, 1)
 
 	// Start a background goroutine.
 	go func() {
@@ -41,6 +88,10 @@ func (app *application) serve() error {
 		// received.
 		s := <-quit
 
+		// Fail the readiness probe straight away, so that load balancers stop sending us new
+		// requests.
+		app.shuttingDown.Store(true)
+
 		// Log a message to say we caught the signal. Notice that we also call the
 		// String() method on the signal to get the signal name and include it in the log
 		// entry properties.
@@ -48,42 +99,73 @@ func (app *application) serve() error {
 			"signal": s.String(),
 		})
 
-		// Create a context with a 5-second timeout.
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		// Keep serving for -shutdown-delay, long enough for the load balancers to see /readyz
+		// fail, so that no new request is sent to a server which no longer accepts connections.
+		if delay := app.config.shutdown.delay; delay > 0 {
+			app.logger.PrintInfo("waiting before draining", map[string]string{
+				"delay": delay.String(),
+			})
+			time.Sleep(delay)
+		}
+
+		// Give the requests in flight -shutdown-timeout to finish.
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdown.timeout)
 		defer cancel()
 
-		// call Shutdown on the server, and only send on the shutdownError channel if it returns
-		// an error
+		for _, a := range aux {
+			if err := a.Shutdown(ctx); err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"addr": a.Addr,
+				})
+			}
+		}
+
+		// If the requests don't finish in time, their connections are closed. The background
+		// tasks are waited for anyway, and the error is reported once they are done.
 		err := srv.Shutdown(ctx)
 		if err != nil {
-			shutdownError <- err
+			err = fmt.Errorf("draining requests: %w", err)
+			srv.Close()
 		}
 
+		// No request is served any more, so the rate limiters can stop removing idle buckets.
+		app.stopRateLimiters()
+
+		// Stop scheduling and claiming jobs, and give up the leadership. The running jobs are
+		// waited for below.
+		stopJobs()
+
 		// Log a message to say that we're waiting for any background goroutines to complete
 		// their tasks.
 		app.logger.PrintInfo("completing background tasks", map[string]string{
 			"addr": srv.Addr,
 		})
 
-		// Call Wait() to block until our WaitGroup counter is zero. This essentially blocks
-		// until the background goroutines have finished. Then we return nil on the shutdownError
-		// channel to indicate that the shutdown as compleeted without any issues.
-		app.wg.Wait()
-		shutdownError <- nil
+		// Block until the background goroutines have finished, or until -shutdown-tasks-timeout
+		// has passed, in which case the ones still running are logged and abandoned.
+		app.waitForTasks(app.config.shutdown.tasksTimeout)
 
+		shutdownError <- err
 	}()
 
 	// Log a "starting server" message.
 	app.logger.PrintInfo("starting server", map[string]string{
 		"addr": srv.Addr,
 		"env":  app.config.env,
+		"tls":  fmt.Sprint(srv.TLSConfig != nil),
 	})
 
 	// Calling Shutdown() on our server will cause ListenAndServer() to immediately
 	// return a http.ErrServerClosed error. So, if we see this error, it is actually a good thing
 	// and an indication that the graceful shutdown has started. So, we specifically check for this,
 	// only returning the error if it is NOT http.ErrServerClosed.
-	err := srv.ListenAndServe()
+	var err error
+	if srv.TLSConfig != nil {
+		// The certificate comes from TLSConfig.GetCertificate.
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -104,3 +186,58 @@ func (app *application) serve() error {
 
 	return nil
 }
+
+// waitForTasks waits for the goroutines started with background to finish, for at most timeout.
+// It reports whether they all finished, and logs the ones which are still running otherwise.
+func (app *application) waitForTasks(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+
+	app.tasksMu.Lock()
+	defer app.tasksMu.Unlock()
+
+	for _, t := range app.tasks {
+		app.logger.PrintError(errors.New("background task still running"), map[string]string{
+			"task":    t.name,
+			"running": time.Since(t.started).Round(time.Millisecond).String(),
+		})
+	}
+	return false
+}
+
+// startAuxServer starts an extra listener in the background, for example for the metrics, and
+// returns its server so that it can be shut down with the main one.
+func (app *application) startAuxServer(name, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ErrorLog:     log.New(app.logger, "", 0),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	go func() {
+		app.logger.PrintInfo("starting "+name+" server", map[string]string{
+			"addr": srv.Addr,
+		})
+
+		err := srv.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			app.logger.PrintError(err, map[string]string{
+				"addr": srv.Addr,
+			})
+		}
+	}()
+
+	return srv
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/justverena/ATLA/pkg/atla/validator"
+)
+
+// certReloader holds the server certificate and lets it be replaced while the server runs.
+// Connections that are already established keep the certificate they were opened with.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload loads the certificate and key files again. The current certificate is kept if they
+// can't be loaded.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+
+	return nil
+}
+
+// getCertificate is used as tls.Config.GetCertificate.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// serverTLSConfig returns the TLS settings of the server: TLS 1.2 or later, with forward secret
+// AEAD cipher suites only (TLS 1.3 suites aren't configurable and are all fine). HTTP/2 is
+// enabled by net/http, which adds "h2" to NextProtos when the server is started with ServeTLS.
+func (app *application) serverTLSConfig(cr *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		GetCertificate: cr.getCertificate,
+	}
+}
+
+// tlsFiles returns the certificate and key files to serve with, generating a self-signed
+// development certificate first if -tls-dev is set.
+func (app *application) tlsFiles() (string, string, error) {
+	if !app.config.tls.dev {
+		return app.config.tls.certFile, app.config.tls.keyFile, nil
+	}
+
+	dir := app.config.tls.devDir
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", "", err
+		}
+		dir = filepath.Join(cacheDir, "atla")
+	}
+
+	certFile := filepath.Join(dir, "dev-cert.pem")
+	keyFile := filepath.Join(dir, "dev-key.pem")
+
+	if devCertValid(certFile, keyFile) {
+		return certFile, keyFile, nil
+	}
+
+	app.logger.PrintInfo("generating self-signed development certificate", map[string]string{
+		"cert": certFile,
+	})
+
+	err := generateDevCert(dir, certFile, keyFile)
+	if err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// devCertValid reports whether a cached development certificate exists and is valid for at
+// least another week.
+func devCertValid(certFile, keyFile string) bool {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return false
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return false
+	}
+	return time.Now().Add(7 * 24 * time.Hour).Before(cert.NotAfter)
+}
+
+// generateDevCert writes a self-signed certificate for localhost, valid for 90 days.
+func generateDevCert(dir, certFile, keyFile string) error {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"ATLA development"}, CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(90 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+}
+
+// redirectToHTTPS answers plaintext requests with a permanent redirect to the same URL on the
+// HTTPS port.
+func (app *application) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if host == "" {
+		http.Error(w, "missing Host header", http.StatusBadRequest)
+		return
+	}
+
+	if app.config.port != 443 {
+		host = net.JoinHostPort(host, fmt.Sprint(app.config.port))
+	}
+
+	// 308 rather than 301, so that clients repeat POST and PUT requests as they are.
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// validateTLSConfig checks that the TLS settings make sense together.
+func validateTLSConfig(v *validator.Validator, c tlsConfig) {
+	v.Check((c.certFile == "") == (c.keyFile == ""), "tls-cert", "tls-cert and tls-key must be set together")
+	v.Check(!c.dev || c.certFile == "", "tls-dev", "can't be combined with tls-cert and tls-key")
+	v.Check(c.redirectAddr == "" || c.enabled(), "tls-redirect-addr", "requires tls-cert and tls-key, or tls-dev")
+}
@@ -9,13 +9,16 @@ import (
 	"github.com/justverena/ATLA/pkg/atla/validator"
 )
 
+// createAuthenticationTokenInput is the request body accepted by
+// createAuthenticationTokenHandler.
+type createAuthenticationTokenInput struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the email and password from the request body.
-
-	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
+	var input createAuthenticationTokenInput
 
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -36,7 +39,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// Lookup the user record based on the email address. If no matching user was found, then we
 	// call the app.invalidCredentialsResponse() helper to send a 501 Unauthorized response to
 	// the client.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -63,14 +66,14 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	// Otherwise, if the password is correct, we generate a new token with a 24-hour expiry time
 	// and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, model.ScopeAuthentication)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, model.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
 	// Encode the token to JSON and send it in the response along with a 201 Created status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.render(w, r, http.StatusCreated, envelope{"authentication_token": token}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
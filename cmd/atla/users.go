@@ -9,15 +9,29 @@ import (
 	"github.com/justverena/ATLA/pkg/atla/validator"
 )
 
+// registerUserInput holds the expected data from the request body of registerUserHandler.
+type registerUserInput struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// registerUserResponse is the "user" member of the registerUserHandler response. It carries the
+// activation token alongside the newly created user.
+type registerUserResponse struct {
+	Token *string     `json:"token"`
+	User  *model.User `json:"user"`
+}
+
+// activateUserInput holds the plaintext activation token sent to activateUserHandler.
+type activateUserInput struct {
+	TokenPlaintext string `json:"token"`
+}
+
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
-	// Create an anonymous struct to hold the expected data from the request body.
-	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
+	var input registerUserInput
 
-	// Parse the request body into the anonymous struct
+	// Parse the request body into the input struct
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
@@ -51,7 +65,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Insert the user data into the database.
-	err = app.models.Users.Insert(user)
+	err = app.models.Users.Insert(r.Context(), user)
 	if err != nil {
 		switch {
 		// If we get an ErrDuplicateEmail error, use the v.AddError() method to manually add
@@ -67,7 +81,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Permissions.AddForUser(user.ID, "characters:read")
+	err = app.models.Permissions.AddForUser(r.Context(), user.ID, "characters:read")
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -75,30 +89,25 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// After the user record has been created in the database, generate a new activation
 	// token for the user.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, model.ScopeActivation)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, model.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	var res struct {
-		Token *string     `json:"token"`
-		User  *model.User `json:"user"`
-	}
+	var res registerUserResponse
 
 	res.Token = &token.Plaintext
 	res.User = user
 
-	app.writeJSON(w, http.StatusCreated, envelope{"user": res}, nil)
+	app.render(w, r, http.StatusCreated, envelope{"user": res}, nil)
 }
 
 // activateUserHandler activates a user by setting 'activation = true' using the provided
 // activation token in the request body.
 func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the plaintext activation token from the request body
-	var input struct {
-		TokenPlaintext string `json:"token"`
-	}
+	var input activateUserInput
 
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -117,7 +126,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	// Retrieve the details of the user associated with the token using the GetForToken() method.
 	// If no matching record is found, then we let the client know that the token they provided
 	// is not valid.
-	user, err := app.models.Users.GetForToken(model.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.Users.GetForToken(r.Context(), model.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -134,7 +143,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// Save the updated user record in our database, checking for any edit conflicts in the same
 	// way that we did for our move records.
-	err = app.models.Users.Update(user)
+	err = app.models.Users.Update(r.Context(), user)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrEditConflict):
@@ -146,11 +155,11 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// If everything went successfully above, then delete all activation tokens for the user.
-	err = app.models.Tokens.DeleteAllForUser(model.ScopeActivation, user.ID)
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), model.ScopeActivation, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	app.render(w, r, http.StatusOK, envelope{"user": user}, nil)
 }
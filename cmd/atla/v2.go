@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// apiVersions lists the path prefix of every API version we serve, newest first.
+var apiVersions = map[string]string{
+	"v2": "/api/v2",
+	"v1": "/api/v1",
+}
+
+// versioned tags every request with the API version its path belongs to, so that render and the
+// link builders know which conventions to follow. It runs before routing so that 404 and 405
+// responses for a version are rendered in that version's format too. Requests to v1 are answered
+// with the Deprecation, Sunset and successor-version Link headers.
+func (app *application) versioned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, apiVersions["v2"]+"/"):
+			r = app.contextSetVersion(r, "v2")
+		case strings.HasPrefix(r.URL.Path, apiVersions["v1"]+"/"):
+			r = app.contextSetVersion(r, "v1")
+
+			h := w.Header()
+			h.Set("Deprecation", fmt.Sprintf("@%d", app.config.v1.deprecation.Unix()))
+			h.Set("Sunset", app.config.v1.sunset.UTC().Format(http.TimeFormat))
+			successor := app.config.baseURL + apiVersions["v2"] + strings.TrimPrefix(r.URL.Path, apiVersions["v1"])
+			h.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// v2Envelope reshapes a handler envelope into the uniform v2 document:
+//
+//	{"data": ..., "meta": {...}, "errors": [...]}
+//
+// The handlers are shared between versions, so they keep producing v1 envelopes and the
+// differences are applied here: "metadata", "message" and "request_id" go to meta, {"error": ...}
+// is turned into a list of error objects, and the remaining members become data. When there is
+// only one of them, its key is dropped (so a single episode is no longer under "episodes"). Every
+// object key in the document is converted to snake_case.
+func v2Envelope(data envelope) (envelope, error) {
+	tree, err := toOrderedTree(data)
+	if err != nil {
+		return nil, err
+	}
+	obj := snakeCaseKeys(tree).(*orderedObject)
+
+	meta := &orderedObject{values: make(map[string]interface{})}
+	body := &orderedObject{values: make(map[string]interface{})}
+	errs := []interface{}{}
+
+	for _, k := range obj.keys {
+		v := obj.values[k]
+
+		switch k {
+		case "error":
+			errs = v2Errors(v)
+		case "metadata":
+			if m, ok := v.(*orderedObject); ok {
+				for _, mk := range m.keys {
+					meta.set(mk, m.values[mk])
+				}
+			}
+		case "message", "request_id":
+			meta.set(k, v)
+		default:
+			body.set(k, v)
+		}
+	}
+
+	var payload interface{}
+	switch len(body.keys) {
+	case 0:
+		payload = nil
+	case 1:
+		payload = body.values[body.keys[0]]
+	default:
+		payload = body
+	}
+
+	return envelope{"data": payload, "meta": meta, "errors": errs}, nil
+}
+
+// v2Errors converts the message passed to errorResponse into a list of error objects. Validation
+// errors, which are a map of field to message, produce one object per field.
+func v2Errors(message interface{}) []interface{} {
+	m, ok := message.(*orderedObject)
+	if !ok {
+		e := &orderedObject{values: make(map[string]interface{})}
+		e.set("message", message)
+		return []interface{}{e}
+	}
+
+	fields := append([]string(nil), m.keys...)
+	sort.Strings(fields)
+
+	errs := make([]interface{}, 0, len(fields))
+	for _, field := range fields {
+		e := &orderedObject{values: make(map[string]interface{})}
+		e.set("field", field)
+		e.set("message", m.values[field])
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// snakeCaseKeys returns a copy of a decoded JSON tree with every object key in snake_case.
+func snakeCaseKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *orderedObject:
+		out := &orderedObject{values: make(map[string]interface{}, len(v.keys))}
+		for _, k := range v.keys {
+			out.set(snakeCase(k), snakeCaseKeys(v.values[k]))
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = snakeCaseKeys(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// snakeCase converts camelCase identifiers, e.g. "createdAt" becomes "created_at". Keys that are
+// already snake_case, and the "_links" key, are left alone.
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i, c := range s {
+		if unicode.IsUpper(c) {
+			if i > 0 && s[i-1] != '_' {
+				b.WriteByte('_')
+			}
+			c = unicode.ToLower(c)
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// set adds or replaces a key, keeping the position of existing keys.
+func (o *orderedObject) set(key string, value interface{}) {
+	if _, exists := o.values[key]; !exists {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// parseDate parses the YYYY-MM-DD dates used by the -v1-deprecation and -v1-sunset flags.
+func parseDate(value string) (time.Time, error) {
+	return time.Parse("2006-01-02", value)
+}
@@ -0,0 +1,311 @@
+// Package archive exports the whole database to a portable archive and restores it.
+//
+// An archive is a tar file, optionally gzipped, holding manifest.json followed by one file of
+// newline-delimited JSON per table, with a row per line. The manifest records the format and
+// schema version of the archive, and the number of rows and the SHA-256 checksum of every file.
+// Rows keep the IDs of the database they were exported from; Import gives them new IDs and
+// rewrites the references between tables to match, so that an archive can be restored into a
+// database that already has data.
+package archive
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// FormatVersion is the version of the archive layout written by Export.
+const FormatVersion = 1
+
+const manifestName = "manifest.json"
+
+var (
+	// ErrConflict is returned by Import, with the fail policy, when an archived row has the same
+	// key as an existing row but different data.
+	ErrConflict = errors.New("conflicting row")
+
+	// ErrChecksum is returned by Import when a file doesn't match the checksum or the number of
+	// rows in the manifest.
+	ErrChecksum = errors.New("archive is corrupted")
+)
+
+// Manifest describes the contents of an archive.
+type Manifest struct {
+	Format        int    `json:"format"`
+	SchemaVersion int    `json:"schema_version"`
+	CreatedAt     string `json:"created_at"`
+	Files         []File `json:"files"`
+}
+
+// File is a table file of an archive.
+type File struct {
+	Name   string `json:"name"`
+	Table  string `json:"table"`
+	Rows   int    `json:"rows"`
+	SHA256 string `json:"sha256"`
+}
+
+// Progress is called while a table is exported or imported with the number of rows done so
+// far, and once more when the table is finished. total is 0 when it isn't known yet.
+type Progress func(table string, done, total int)
+
+// progressEvery is the number of rows between two calls of a Progress function.
+const progressEvery = 500
+
+// table describes how a table is archived.
+type table struct {
+	name    string
+	columns []string
+	// key identifies a row across databases, since IDs don't.
+	key []string
+	// serial tables have an id generated by the database, which is replaced on import.
+	serial bool
+	// references maps the foreign key columns to the tables they refer to.
+	references map[string]string
+	// since is the schema version which created the table.
+	since int
+	// added maps the columns added after the table was created to the schema version which
+	// added them.
+	added map[string]int
+	// where filters the exported rows.
+	where string
+}
+
+// tables are the archived tables, in an order where every table comes after the tables it
+// refers to.
+var tables = []table{
+	{
+		name:    "characters",
+		columns: []string{"id", "name", "age", "gender", "status", "nation", "created_at", "updated_at"},
+		key:     []string{"name"},
+		serial:  true,
+		since:   1,
+	},
+	{
+		name:    "episodes",
+		columns: []string{"id", "title", "air_date", "created_at", "updated_at"},
+		key:     []string{"title"},
+		serial:  true,
+		since:   1,
+	},
+	{
+		name:    "quotes",
+		columns: []string{"id", "quote", "created_at", "updated_at"},
+		key:     []string{"quote"},
+		serial:  true,
+		since:   1,
+	},
+	{
+		name:       "characters_and_episodes",
+		columns:    []string{"id", "character_id", "episode_id", "created_at", "updated_at"},
+		key:        []string{"character_id", "episode_id"},
+		serial:     true,
+		references: map[string]string{"character_id": "characters", "episode_id": "episodes"},
+		since:      1,
+	},
+	{
+		name:       "characters_and_quotes",
+		columns:    []string{"id", "character_id", "quote_id", "created_at", "updated_at"},
+		key:        []string{"character_id", "quote_id"},
+		serial:     true,
+		references: map[string]string{"character_id": "characters", "quote_id": "quotes"},
+		since:      1,
+	},
+	{
+		name:    "users",
+		columns: []string{"id", "created_at", "name", "email", "password_hash", "activated", "version", "activated_at"},
+		key:     []string{"email"},
+		serial:  true,
+		since:   2,
+		added:   map[string]int{"activated_at": 9},
+	},
+	{
+		name:       "tokens",
+		columns:    []string{"hash", "user_id", "expiry", "scope"},
+		key:        []string{"hash"},
+		references: map[string]string{"user_id": "users"},
+		since:      3,
+		where:      "expiry > NOW()",
+	},
+	{
+		name:    "permissions",
+		columns: []string{"id", "code"},
+		key:     []string{"code"},
+		serial:  true,
+		since:   4,
+	},
+	{
+		name:       "users_permissions",
+		columns:    []string{"user_id", "permission_id"},
+		key:        []string{"user_id", "permission_id"},
+		references: map[string]string{"user_id": "users", "permission_id": "permissions"},
+		since:      4,
+	},
+}
+
+// bookkeeping are the columns which don't make two rows with the same key different.
+var bookkeeping = []string{"id", "created_at", "updated_at", "version", "activated_at"}
+
+func (t table) file() string {
+	return t.name + ".ndjson"
+}
+
+// at returns t with the columns it has at the given schema version.
+func (t table) at(version int) table {
+	columns := make([]string, 0, len(t.columns))
+	for _, c := range t.columns {
+		if t.added[c] <= version {
+			columns = append(columns, c)
+		}
+	}
+	t.columns = columns
+	return t
+}
+
+// data returns the columns which are written on import: all of them but the generated id.
+func (t table) data() []string {
+	if !t.serial {
+		return t.columns
+	}
+	return t.columns[1:]
+}
+
+// compared returns the columns whose values have to match for an archived row to be the same
+// as an existing row with the same key.
+func (t table) compared() []string {
+	var columns []string
+	for _, c := range t.columns {
+		if !contains(t.key, c) && !contains(bookkeeping, c) {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+// selectQuery reads the rows of the table as JSON objects.
+func (t table) selectQuery() string {
+	where := ""
+	if t.where != "" {
+		where = "WHERE " + t.where
+	}
+	order := strings.Join(t.key, ", ")
+	if t.serial {
+		order = "id"
+	}
+	return fmt.Sprintf(`
+		SELECT row_to_json(r)
+		FROM (SELECT %s FROM %s %s ORDER BY %s) r`,
+		strings.Join(t.columns, ", "), t.name, where, order)
+}
+
+// The import queries take an archived row as a JSON object in $1, and let Postgres convert its
+// values to the types of the columns with json_populate_record.
+
+// findQuery looks up the row with the key of the archived row. It returns its id, and whether
+// it has the same data.
+//
+// The keys of serial tables, such as character names, aren't unique, so their rows are matched
+// one to one: rows which were created or matched earlier in the import, which are listed in the
+// importedTable, are left out, and an identical row is preferred to a different one.
+func (t table) findQuery() string {
+	same := "true"
+	if compared := t.compared(); len(compared) > 0 {
+		same = fmt.Sprintf("ROW(%s) IS NOT DISTINCT FROM ROW(%s)", prefixed("t.", compared), prefixed("r.", compared))
+	}
+	if !t.serial {
+		return fmt.Sprintf(`
+			SELECT 0::bigint, %s
+			FROM %s t, json_populate_record(NULL::%[2]s, $1::json) r
+			WHERE %s
+			LIMIT 1`,
+			same, t.name, t.keyCondition())
+	}
+	return fmt.Sprintf(`
+		SELECT t.id, %s
+		FROM %s t, json_populate_record(NULL::%[2]s, $1::json) r
+		WHERE %s
+			AND NOT EXISTS (SELECT 1 FROM %s i WHERE i.table_name = '%[2]s' AND i.id = t.id)
+		ORDER BY 2 DESC, t.id
+		LIMIT 1`,
+		same, t.name, t.keyCondition(), importedTable)
+}
+
+func (t table) insertQuery() string {
+	query := fmt.Sprintf(`
+		INSERT INTO %s (%s)
+		SELECT %[2]s FROM json_populate_record(NULL::%[1]s, $1::json)`,
+		t.name, strings.Join(t.data(), ", "))
+	if t.serial {
+		query += " RETURNING id"
+	}
+	return query
+}
+
+// updateQuery overwrites the row found by findQuery with the archived row: the one with the id
+// in $2 for serial tables, and the one with the key of the archived row, which is their primary
+// key, for the others. Tables whose columns are all part of the key have nothing to overwrite.
+func (t table) updateQuery() string {
+	var set []string
+	for _, c := range t.data() {
+		if !contains(t.key, c) {
+			set = append(set, fmt.Sprintf("%s = r.%[1]s", c))
+		}
+	}
+	if len(set) == 0 {
+		return ""
+	}
+	where := t.keyCondition()
+	if t.serial {
+		where = "t.id = $2"
+	}
+	return fmt.Sprintf(`
+		UPDATE %s t
+		SET %s
+		FROM json_populate_record(NULL::%[1]s, $1::json) r
+		WHERE %[3]s`,
+		t.name, strings.Join(set, ", "), where)
+}
+
+func (t table) keyCondition() string {
+	conditions := make([]string, len(t.key))
+	for i, c := range t.key {
+		conditions[i] = fmt.Sprintf("t.%s = r.%[1]s", c)
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+func prefixed(prefix string, columns []string) string {
+	p := make([]string, len(columns))
+	for i, c := range columns {
+		p[i] = prefix + c
+	}
+	return strings.Join(p, ", ")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaVersion reads the migration version of the database that tx belongs to.
+func schemaVersion(ctx context.Context, tx *sql.Tx) (int, error) {
+	var version int
+	var dirty bool
+
+	err := tx.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return 0, nil
+	case err != nil:
+		return 0, fmt.Errorf("reading the schema version: %w", err)
+	case dirty:
+		return 0, fmt.Errorf("database is dirty at schema version %d: repair it with atla migrate force", version)
+	}
+	return version, nil
+}
@@ -0,0 +1,301 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/justverena/ATLA/pkg/atla/migrations"
+	_ "github.com/lib/pq"
+)
+
+// testDSNEnv names the environment variable with the DSN of a PostgreSQL database for the round
+// trip test, which is skipped when it isn't set. The test migrates the database up, and removes
+// the rows it adds.
+const testDSNEnv = "ATLA_TEST_DB_DSN"
+
+func TestUpgrades(t *testing.T) {
+	for _, v := range migrations.Versions()[1:] {
+		if _, ok := upgrades[v]; !ok {
+			t.Errorf("migration %d has no entry in upgrades", v)
+		}
+	}
+}
+
+func TestUpgradesBetween(t *testing.T) {
+	latest := migrations.Latest()
+
+	tests := []struct {
+		name     string
+		from, to int
+		wantErr  bool
+	}{
+		{name: "oldest archive", from: 1, to: latest},
+		{name: "same version", from: latest, to: latest},
+		{name: "older database", from: 1, to: 1},
+		{name: "archive newer than the database", from: latest, to: 1, wantErr: true},
+		{name: "database newer than the binary", from: 1, to: latest + 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			convert, err := upgradesBetween(tt.from, tt.to)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.from == tt.to && len(convert) != 0 {
+				t.Errorf("got %d upgrades, want none", len(convert))
+			}
+		})
+	}
+}
+
+func TestTableAt(t *testing.T) {
+	tbl := table{columns: []string{"id", "name", "nickname", "email"}, added: map[string]int{"nickname": 3, "email": 5}}
+
+	tests := []struct {
+		version int
+		want    []string
+	}{
+		{version: 2, want: []string{"id", "name"}},
+		{version: 3, want: []string{"id", "name", "nickname"}},
+		{version: 5, want: []string{"id", "name", "nickname", "email"}},
+	}
+
+	for _, tt := range tests {
+		if got := tbl.at(tt.version).columns; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("at(%d) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestRemapReferences(t *testing.T) {
+	links := findTable("characters_and_episodes")
+	ids := map[string]map[int64]int64{
+		"characters": {1: 101, 2: 102},
+		"episodes":   {7: 207},
+	}
+
+	tests := []struct {
+		name    string
+		row     row
+		want    row
+		wantErr bool
+	}{
+		{
+			name: "remapped",
+			row:  row{"id": json.Number("3"), "character_id": json.Number("2"), "episode_id": json.Number("7")},
+			want: row{"id": json.Number("3"), "character_id": int64(102), "episode_id": int64(207)},
+		},
+		{
+			name:    "missing reference",
+			row:     row{"id": json.Number("3"), "character_id": json.Number("3"), "episode_id": json.Number("7")},
+			wantErr: true,
+		},
+		{
+			name:    "not an integer",
+			row:     row{"id": json.Number("3"), "character_id": json.Number("1.5"), "episode_id": json.Number("7")},
+			wantErr: true,
+		},
+		{
+			name:    "not a number",
+			row:     row{"id": json.Number("3"), "character_id": "1", "episode_id": json.Number("7")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := remapReferences(links, tt.row, ids)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", tt.row)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.row, tt.want) {
+				t.Errorf("got %v, want %v", tt.row, tt.want)
+			}
+		})
+	}
+
+	// Tables without references are left alone.
+	r := row{"id": json.Number("1"), "name": "Aang"}
+	if err := remapReferences(findTable("characters"), r, ids); err != nil || r["id"] != json.Number("1") {
+		t.Errorf("got %v, %v, want the row unchanged", r, err)
+	}
+}
+
+func TestUpgradeActivatedAt(t *testing.T) {
+	tests := []struct {
+		name  string
+		table string
+		row   row
+		want  interface{}
+	}{
+		{"activated", "users", row{"activated": true, "version": json.Number("2"), "created_at": "2024-01-02T03:04:05Z"}, "2024-01-02T03:04:05Z"},
+		{"deactivated after registering", "users", row{"activated": false, "version": json.Number("3"), "created_at": "2024-01-02T03:04:05Z"}, "2024-01-02T03:04:05Z"},
+		{"never activated", "users", row{"activated": false, "version": json.Number("1"), "created_at": "2024-01-02T03:04:05Z"}, nil},
+		{"other table", "characters", row{"activated": true, "version": json.Number("2"), "created_at": "2024-01-02T03:04:05Z"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := upgradeActivatedAt(tt.table, tt.row); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.row["activated_at"]; got != tt.want {
+				t.Errorf("activated_at = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if err := upgradeActivatedAt("users", row{"activated": false}); err == nil {
+		t.Error("got no error for a user without a version, want one")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s isn't set", testDSNEnv)
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if _, err := migrations.New(db).Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Names of their own keep the rows of the test apart from the data of the database.
+	suffix := fmt.Sprintf(" %d", time.Now().UnixNano())
+	name, title, text := "Aang"+suffix, "The Boy in the Iceberg"+suffix, "Yip yip!"+suffix
+
+	var s testRows
+	err = db.QueryRow(`INSERT INTO characters (name, age, gender, status, nation)
+		VALUES ($1, 112, 'male', 'alive', 'Air Nomads') RETURNING id`, name).Scan(&s.character)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.delete(context.Background(), db) })
+
+	err = db.QueryRow(`INSERT INTO episodes (title, air_date) VALUES ($1, '2005-02-21') RETURNING id`, title).Scan(&s.episode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow(`INSERT INTO quotes (quote) VALUES ($1) RETURNING id`, text).Scan(&s.quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO characters_and_episodes (character_id, episode_id) VALUES ($1, $2)`, s.character, s.episode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO characters_and_quotes (character_id, quote_id) VALUES ($1, $2)`, s.character, s.quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	manifest, err := Export(ctx, db, &buf, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// Without the rows of the test, the import has to create them again, with new IDs, while
+	// the rest of the database is unchanged.
+	if err := s.delete(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Import(ctx, tx, &buf, PolicyFail, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := map[string]int{"characters": 1, "episodes": 1, "quotes": 1, "characters_and_episodes": 1, "characters_and_quotes": 1}
+	for _, file := range manifest.Files {
+		want := Counts{Created: created[file.Table], Unchanged: file.Rows - created[file.Table]}
+		if got := result.Tables[file.Table]; got == nil || *got != want {
+			t.Errorf("%s: got %+v, want %+v", file.Table, got, want)
+		}
+	}
+
+	// The links refer to the new IDs of the rows they connect.
+	var episodes, quotes int
+	err = tx.QueryRow(`
+		SELECT count(*)
+		FROM characters_and_episodes ce
+		JOIN characters c ON c.id = ce.character_id
+		JOIN episodes e ON e.id = ce.episode_id
+		WHERE c.name = $1 AND e.title = $2 AND c.id <> $3 AND e.id <> $4`,
+		name, title, s.character, s.episode).Scan(&episodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.QueryRow(`
+		SELECT count(*)
+		FROM characters_and_quotes cq
+		JOIN characters c ON c.id = cq.character_id
+		JOIN quotes q ON q.id = cq.quote_id
+		WHERE c.name = $1 AND q.quote = $2 AND c.id <> $3 AND q.id <> $4`,
+		name, text, s.character, s.quote).Scan(&quotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if episodes != 1 || quotes != 1 {
+		t.Errorf("%d episode and %d quote links between the imported rows, want 1 and 1", episodes, quotes)
+	}
+}
+
+// testRows are the IDs of the rows added by TestRoundTrip.
+type testRows struct {
+	character, episode, quote int64
+}
+
+func (s testRows) delete(ctx context.Context, db interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}) error {
+	queries := []struct {
+		query string
+		id    int64
+	}{
+		{`DELETE FROM characters_and_episodes WHERE character_id = $1`, s.character},
+		{`DELETE FROM characters_and_quotes WHERE character_id = $1`, s.character},
+		{`DELETE FROM characters WHERE id = $1`, s.character},
+		{`DELETE FROM episodes WHERE id = $1`, s.episode},
+		{`DELETE FROM quotes WHERE id = $1`, s.quote},
+	}
+	for _, q := range queries {
+		if _, err := db.ExecContext(ctx, q.query, q.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
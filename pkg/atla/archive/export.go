@@ -0,0 +1,167 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Export writes every table of db to w as an archive, gzipped if compress is set. The tables
+// are read in a single read-only transaction, so the archive is a consistent snapshot even while
+// the API is writing. Expired tokens are left out.
+func Export(ctx context.Context, db *sql.DB, w io.Writer, compress bool, progress Progress) (Manifest, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer tx.Rollback()
+
+	version, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if version == 0 {
+		return Manifest{}, errors.New("database has no schema: run atla migrate up first")
+	}
+
+	manifest := Manifest{
+		Format:        FormatVersion,
+		SchemaVersion: version,
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+	}
+
+	// A tar header needs the size of the file, so the tables are written to temporary files
+	// first, which also lets the manifest with their checksums come first in the archive.
+	var temps []*os.File
+	defer func() {
+		for _, f := range temps {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	for _, t := range tables {
+		if t.since > version {
+			continue
+		}
+		t = t.at(version)
+
+		f, err := os.CreateTemp("", "atla-export-*.ndjson")
+		if err != nil {
+			return Manifest{}, err
+		}
+		temps = append(temps, f)
+
+		file, err := exportTable(ctx, tx, t, f, progress)
+		if err != nil {
+			return Manifest{}, err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Manifest{}, err
+	}
+
+	if err := writeArchive(w, compress, manifest, temps); err != nil {
+		return Manifest{}, err
+	}
+	return manifest, nil
+}
+
+// exportTable writes the rows of t to f, a line each.
+func exportTable(ctx context.Context, tx *sql.Tx, t table, f *os.File, progress Progress) (File, error) {
+	rows, err := tx.QueryContext(ctx, t.selectQuery())
+	if err != nil {
+		return File{}, err
+	}
+	defer rows.Close()
+
+	hash := sha256.New()
+	buf := bufio.NewWriter(io.MultiWriter(f, hash))
+	n := 0
+
+	for rows.Next() {
+		var row []byte
+		if err := rows.Scan(&row); err != nil {
+			return File{}, err
+		}
+		buf.Write(row)
+		buf.WriteByte('\n')
+
+		n++
+		if progress != nil && n%progressEvery == 0 {
+			progress(t.name, n, 0)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return File{}, err
+	}
+	if err := buf.Flush(); err != nil {
+		return File{}, err
+	}
+	if progress != nil {
+		progress(t.name, n, n)
+	}
+
+	return File{Name: t.file(), Table: t.name, Rows: n, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func writeArchive(w io.Writer, compress bool, manifest Manifest, files []*os.File) error {
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+
+	js, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+
+	modTime := time.Now()
+	err = tw.WriteHeader(&tar.Header{Name: manifestName, Mode: 0o644, Size: int64(len(js)), ModTime: modTime})
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(js); err != nil {
+		return err
+	}
+
+	for i, f := range files {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		err = tw.WriteHeader(&tar.Header{Name: manifest.Files[i].Name, Mode: 0o644, Size: info.Size(), ModTime: modTime})
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
+}
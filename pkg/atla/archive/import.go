@@ -0,0 +1,396 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/justverena/ATLA/pkg/atla/migrations"
+)
+
+// Policy decides what Import does with an archived row whose key is already used by an existing
+// row with different data.
+type Policy string
+
+const (
+	PolicySkip      Policy = "skip"      // keep the existing row
+	PolicyOverwrite Policy = "overwrite" // replace the existing row with the archived one
+	PolicyFail      Policy = "fail"      // stop the import with ErrConflict
+)
+
+// Policies are the valid policies.
+var Policies = []string{string(PolicySkip), string(PolicyOverwrite), string(PolicyFail)}
+
+// Counts are the numbers of archived rows of a table that were created, overwrote an existing
+// row, were identical to an existing row, or conflicted with an existing row that was kept.
+type Counts struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Skipped   int `json:"skipped"`
+}
+
+// Result is the outcome of an import.
+type Result struct {
+	Manifest Manifest           `json:"manifest"`
+	Tables   map[string]*Counts `json:"tables"`
+}
+
+// row is an archived row, with numbers kept as json.Number.
+type row map[string]interface{}
+
+// upgrades convert rows archived before a migration to the schema after it, keyed by the version
+// of the migration. Every migration needs an entry, nil when it changes no archived row:
+// migrations that only add tables need nothing, since older archives don't have those tables.
+var upgrades = map[int]func(table string, r row) error{
+	2: nil, // create users
+	3: nil, // create tokens
+	4: nil, // add permissions
+	5: nil, // add the metrics:read permission
+	6: nil, // cascade deletes to the links of characters
+	7: nil, // add the episodes:write and quotes:write permissions
+	8: nil, // create jobs, which aren't archived
+	9: upgradeActivatedAt,
+}
+
+// upgradeActivatedAt fills in users.activated_at the way migration 9 does: users who are
+// activated, or were changed after registering, are taken to be activated when they registered.
+func upgradeActivatedAt(table string, r row) error {
+	if table != "users" {
+		return nil
+	}
+	version, err := rowID(r, "version")
+	if err != nil {
+		return err
+	}
+	if r["activated"] == true || version > 1 {
+		r["activated_at"] = r["created_at"]
+	}
+	return nil
+}
+
+// importedTable is the temporary table which lists, by table, the IDs of the rows created or
+// matched by the import so far.
+const importedTable = "archive_imported"
+
+// Import restores the archive read from r, gzipped or not, into the database of tx. Rows are
+// matched with the existing ones on their keys (names, titles, emails and so on), each existing
+// row with at most one archived row, so that archived rows sharing a key stay apart. They get
+// new IDs, and references are rewritten to the new IDs. Archives from older schema versions are
+// upgraded to the schema of the database by the upgrades of the migrations in between.
+//
+// Rows are written as the archive is read, so a corrupted file is only detected once it has
+// been imported: the caller must roll tx back when Import fails.
+func Import(ctx context.Context, tx *sql.Tx, r io.Reader, policy Policy, progress Progress) (Result, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return Result{}, err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+	tr := tar.NewReader(r)
+
+	manifest, err := readManifest(tr)
+	if err != nil {
+		return Result{}, err
+	}
+	result := Result{Manifest: manifest, Tables: make(map[string]*Counts)}
+
+	version, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return result, err
+	}
+	convert, err := upgradesBetween(manifest.SchemaVersion, version)
+	if err != nil {
+		return result, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		CREATE TEMPORARY TABLE `+importedTable+` (
+			table_name text   NOT NULL,
+			id         bigint NOT NULL,
+			PRIMARY KEY (table_name, id)
+		) ON COMMIT DROP`)
+	if err != nil {
+		return result, err
+	}
+
+	// ids maps the IDs of the archive to the IDs in the database, by table.
+	ids := make(map[string]map[int64]int64)
+
+	for _, file := range manifest.Files {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return result, fmt.Errorf("%w: %s is missing", ErrChecksum, file.Name)
+		} else if err != nil {
+			return result, err
+		}
+		if hdr.Name != file.Name {
+			return result, fmt.Errorf("%w: expected %s, found %s", ErrChecksum, file.Name, hdr.Name)
+		}
+
+		t := findTable(file.Table).at(version)
+		counts := &Counts{}
+		result.Tables[t.name] = counts
+		ids[t.name] = make(map[int64]int64)
+
+		err = importTable(ctx, tx, t, tr, file, convert, policy, ids, counts, progress)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", file.Name, err)
+		}
+	}
+
+	if hdr, err := tr.Next(); err == nil {
+		return result, fmt.Errorf("%w: %s isn't in the manifest", ErrChecksum, hdr.Name)
+	} else if !errors.Is(err, io.EOF) {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// readManifest reads the first file of the archive, which must be the manifest, and checks
+// that it describes known tables in the order they are imported.
+func readManifest(tr *tar.Reader) (Manifest, error) {
+	var manifest Manifest
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return manifest, fmt.Errorf("reading archive: %w", err)
+	}
+	if hdr.Name != manifestName {
+		return manifest, fmt.Errorf("not an atla archive: %s must be the first file", manifestName)
+	}
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("%s: %w", manifestName, err)
+	}
+
+	if manifest.Format != FormatVersion {
+		return manifest, fmt.Errorf("unsupported archive format %d, expected %d", manifest.Format, FormatVersion)
+	}
+	if manifest.SchemaVersion < 1 {
+		return manifest, fmt.Errorf("%s: invalid schema version %d", manifestName, manifest.SchemaVersion)
+	}
+
+	next := 0
+	for _, file := range manifest.Files {
+		i := tableIndex(file.Table)
+		switch {
+		case i < 0:
+			return manifest, fmt.Errorf("%s: unknown table %q", manifestName, file.Table)
+		case i < next:
+			return manifest, fmt.Errorf("%s: %s is out of order or listed twice", manifestName, file.Table)
+		case tables[i].since > manifest.SchemaVersion:
+			return manifest, fmt.Errorf("%s: %s doesn't exist at schema version %d", manifestName, file.Table, manifest.SchemaVersion)
+		case file.Name != tables[i].file():
+			return manifest, fmt.Errorf("%s: the file of %s must be %s", manifestName, file.Table, tables[i].file())
+		}
+		next = i + 1
+	}
+
+	return manifest, nil
+}
+
+// upgradesBetween returns the upgrades which convert rows from schema version from to to.
+func upgradesBetween(from, to int) ([]func(string, row) error, error) {
+	if to > migrations.Latest() {
+		return nil, fmt.Errorf("database schema version %d is newer than this atla, which knows up to %d", to, migrations.Latest())
+	}
+	if from > to {
+		return nil, fmt.Errorf("archive is from schema version %d, newer than the database's %d: run atla migrate up first", from, to)
+	}
+
+	var convert []func(string, row) error
+	for _, v := range migrations.Versions() {
+		if v <= from || v > to {
+			continue
+		}
+		upgrade, ok := upgrades[v]
+		if !ok {
+			return nil, fmt.Errorf("archives from schema version %d can't be imported: migration %d has no upgrade", from, v)
+		}
+		if upgrade != nil {
+			convert = append(convert, upgrade)
+		}
+	}
+	return convert, nil
+}
+
+// importTable imports the rows of the file of t, which tr is positioned at, and checks them
+// against the manifest.
+func importTable(ctx context.Context, tx *sql.Tx, t table, tr *tar.Reader, file File,
+	convert []func(string, row) error, policy Policy, ids map[string]map[int64]int64, counts *Counts, progress Progress) error {
+	find, insert, update := t.findQuery(), t.insertQuery(), t.updateQuery()
+
+	hash := sha256.New()
+	scanner := bufio.NewScanner(io.TeeReader(tr, hash))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	n := 0
+
+	for scanner.Scan() {
+		n++
+		r := make(row)
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.UseNumber()
+		if err := dec.Decode(&r); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+
+		for _, upgrade := range convert {
+			if err := upgrade(t.name, r); err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+		}
+
+		err := importRow(ctx, tx, t, r, find, insert, update, policy, ids, counts)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+
+		if progress != nil && n%progressEvery == 0 {
+			progress(t.name, n, file.Rows)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if n != file.Rows || hex.EncodeToString(hash.Sum(nil)) != file.SHA256 {
+		return fmt.Errorf("%w: the file doesn't match its checksum", ErrChecksum)
+	}
+	if progress != nil {
+		progress(t.name, n, file.Rows)
+	}
+	return nil
+}
+
+// importRow inserts r, or resolves its conflict with the existing row with the same key, and
+// records the ID it has in the database.
+func importRow(ctx context.Context, tx *sql.Tx, t table, r row, find, insert, update string,
+	policy Policy, ids map[string]map[int64]int64, counts *Counts) error {
+	if err := remapReferences(t, r, ids); err != nil {
+		return err
+	}
+
+	var oldID int64
+	if t.serial {
+		var err error
+		if oldID, err = rowID(r, "id"); err != nil {
+			return err
+		}
+		delete(r, "id")
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	js := string(data)
+
+	var id int64
+	var same bool
+	err = tx.QueryRowContext(ctx, find, js).Scan(&id, &same)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if t.serial {
+			err = tx.QueryRowContext(ctx, insert, js).Scan(&id)
+		} else {
+			_, err = tx.ExecContext(ctx, insert, js)
+		}
+		if err != nil {
+			return err
+		}
+		counts.Created++
+	case err != nil:
+		return err
+	case same:
+		counts.Unchanged++
+	case policy == PolicySkip:
+		counts.Skipped++
+	case policy == PolicyOverwrite:
+		args := []interface{}{js}
+		if t.serial {
+			args = append(args, id)
+		}
+		if _, err := tx.ExecContext(ctx, update, args...); err != nil {
+			return err
+		}
+		counts.Updated++
+	default:
+		return fmt.Errorf("%w: %s with %s exists with different data", ErrConflict, t.name, describeKey(t, r))
+	}
+
+	if t.serial {
+		ids[t.name][oldID] = id
+		_, err := tx.ExecContext(ctx, `INSERT INTO `+importedTable+` (table_name, id) VALUES ($1, $2)`, t.name, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remapReferences rewrites the foreign keys of r from the IDs of the archive to the IDs that the
+// referenced rows have in the database.
+func remapReferences(t table, r row, ids map[string]map[int64]int64) error {
+	for column, ref := range t.references {
+		old, err := rowID(r, column)
+		if err != nil {
+			return err
+		}
+		id, ok := ids[ref][old]
+		if !ok {
+			return fmt.Errorf("%s refers to %s %d, which isn't in the archive", column, ref, old)
+		}
+		r[column] = id
+	}
+	return nil
+}
+
+func rowID(r row, column string) (int64, error) {
+	n, ok := r[column].(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("%s must be a number", column)
+	}
+	id, err := n.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer", column)
+	}
+	return id, nil
+}
+
+func describeKey(t table, r row) string {
+	parts := make([]string, len(t.key))
+	for i, c := range t.key {
+		parts[i] = fmt.Sprintf("%s %v", c, r[c])
+	}
+	return strings.Join(parts, " and ")
+}
+
+func tableIndex(name string) int {
+	for i, t := range tables {
+		if t.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func findTable(name string) table {
+	return tables[tableIndex(name)]
+}
@@ -0,0 +1,433 @@
+// Package fixtures holds the canonical development dataset and loads fixture files into the
+// database through the model layer.
+//
+// A fixture set is a directory with a file per resource, named after it, in either JSON or CSV:
+// characters, episodes, quotes and appearances (which characters appear in which episodes).
+// JSON files are objects with a format "version" and a list named after the resource, e.g.
+// {"version": 1, "characters": [...]}. CSV files have a header row naming the columns. Records
+// refer to each other by their natural keys: character names, episode titles and quote texts.
+package fixtures
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/justverena/ATLA/pkg/atla/model"
+	"github.com/justverena/ATLA/pkg/atla/validator"
+)
+
+// Canonical is the dataset shipped with the repository.
+//
+//go:embed *.json *.csv
+var Canonical embed.FS
+
+// FormatVersion is the version of the JSON fixture format that Load understands.
+const FormatVersion = 1
+
+// Resources are the resources of a fixture set, in the order they are seeded.
+var Resources = []string{"characters", "episodes", "quotes", "appearances"}
+
+type Character struct {
+	Name   string `json:"name"`
+	Age    int    `json:"age"`
+	Gender string `json:"gender"`
+	Status string `json:"status"`
+	Nation string `json:"nation"`
+}
+
+type Episode struct {
+	Title   string `json:"title"`
+	AirDate string `json:"air_date"`
+}
+
+// Quote is a quote and, optionally, the name of the character who said it.
+type Quote struct {
+	Quote     string `json:"quote"`
+	Character string `json:"character"`
+}
+
+// Appearance links a character to an episode.
+type Appearance struct {
+	Character string `json:"character"`
+	Episode   string `json:"episode"`
+}
+
+// Dataset is a loaded fixture set.
+type Dataset struct {
+	Characters  []Character
+	Episodes    []Episode
+	Quotes      []Quote
+	Appearances []Appearance
+}
+
+// Load reads the fixture files in the root of fsys. A resource without a file is left empty.
+func Load(fsys fs.FS) (Dataset, error) {
+	var data Dataset
+
+	for _, resource := range Resources {
+		var dst interface{}
+		switch resource {
+		case "characters":
+			dst = &data.Characters
+		case "episodes":
+			dst = &data.Episodes
+		case "quotes":
+			dst = &data.Quotes
+		case "appearances":
+			dst = &data.Appearances
+		}
+
+		err := loadResource(fsys, resource, dst)
+		if err != nil {
+			return Dataset{}, err
+		}
+	}
+
+	return data, nil
+}
+
+// loadResource decodes <resource>.json or <resource>.csv into dst, a pointer to a slice.
+func loadResource(fsys fs.FS, resource string, dst interface{}) error {
+	jsonData, jsonErr := fs.ReadFile(fsys, resource+".json")
+	csvData, csvErr := fs.ReadFile(fsys, resource+".csv")
+
+	switch {
+	case jsonErr == nil && csvErr == nil:
+		return fmt.Errorf("%s: found both %[1]s.json and %[1]s.csv", resource)
+	case jsonErr == nil:
+		return decodeJSON(resource, jsonData, dst)
+	case csvErr == nil:
+		if err := decodeCSV(bytes.NewReader(csvData), dst); err != nil {
+			return fmt.Errorf("%s.csv: %w", resource, err)
+		}
+		return nil
+	case errors.Is(jsonErr, fs.ErrNotExist) && errors.Is(csvErr, fs.ErrNotExist):
+		return nil
+	case !errors.Is(jsonErr, fs.ErrNotExist):
+		return jsonErr
+	default:
+		return csvErr
+	}
+}
+
+func decodeJSON(resource string, data []byte, dst interface{}) error {
+	var fields map[string]json.RawMessage
+
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return fmt.Errorf("%s.json: %w", resource, err)
+	}
+	for name := range fields {
+		if name != "version" && name != resource {
+			return fmt.Errorf("%s.json: unknown field %q", resource, name)
+		}
+	}
+
+	var version int
+	if err := json.Unmarshal(fields["version"], &version); err != nil || version != FormatVersion {
+		return fmt.Errorf("%s.json: unsupported version, expected %d", resource, FormatVersion)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(fields[resource]))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return fmt.Errorf("%s.json: %w", resource, err)
+	}
+	return nil
+}
+
+// decodeCSV decodes the rows of a CSV file into dst, a pointer to a slice of structs. Columns are
+// matched to fields by their JSON names.
+func decodeCSV(r io.Reader, dst interface{}) error {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+
+	slice := reflect.ValueOf(dst).Elem()
+	typ := slice.Type().Elem()
+
+	fields := make([]int, len(header))
+	for i, column := range header {
+		fields[i] = -1
+		for j := 0; j < typ.NumField(); j++ {
+			if strings.Split(typ.Field(j).Tag.Get("json"), ",")[0] == strings.TrimSpace(column) {
+				fields[i] = j
+			}
+		}
+		if fields[i] < 0 {
+			return fmt.Errorf("unknown column %q", column)
+		}
+	}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line, _ := cr.FieldPos(0)
+		item := reflect.New(typ).Elem()
+		for i, value := range record {
+			field := item.Field(fields[i])
+			switch field.Kind() {
+			case reflect.Int:
+				n, err := strconv.Atoi(strings.TrimSpace(value))
+				if err != nil {
+					return fmt.Errorf("line %d: %s must be an integer", line, header[i])
+				}
+				field.SetInt(int64(n))
+			default:
+				field.SetString(value)
+			}
+		}
+		slice.Set(reflect.Append(slice, item))
+	}
+}
+
+// Counts are the numbers of records of a resource that were created, updated or left alone
+// because they were up to date.
+type Counts struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+}
+
+// Summary holds the Counts of every seeded resource.
+type Summary map[string]*Counts
+
+// Seed upserts the resources of data into the database of models, all of them if resources is
+// empty. Running it twice changes nothing the second time. Records referenced by the seeded ones
+// (the characters of the quotes, for example) have to exist already, or be seeded in the same
+// run.
+func Seed(ctx context.Context, models model.Models, data Dataset, resources []string) (Summary, error) {
+	if len(resources) == 0 {
+		resources = Resources
+	}
+
+	summary := make(Summary)
+	for _, resource := range Resources {
+		if !validator.In(resource, resources...) {
+			continue
+		}
+
+		counts := &Counts{}
+		summary[resource] = counts
+
+		var err error
+		switch resource {
+		case "characters":
+			err = seedCharacters(ctx, models, data.Characters, counts)
+		case "episodes":
+			err = seedEpisodes(ctx, models, data.Episodes, counts)
+		case "quotes":
+			err = seedQuotes(ctx, models, data.Quotes, counts)
+		case "appearances":
+			err = seedAppearances(ctx, models, data.Appearances, counts)
+		}
+		if err != nil {
+			return summary, fmt.Errorf("%s: %w", resource, err)
+		}
+	}
+
+	return summary, nil
+}
+
+func seedCharacters(ctx context.Context, models model.Models, characters []Character, counts *Counts) error {
+	for i, c := range characters {
+		character := &model.Character{Name: c.Name, Age: c.Age, Gender: c.Gender, Status: c.Status, Nation: c.Nation}
+
+		v := validator.New()
+		if model.ValidateCharacter(v, character); !v.Valid() {
+			return invalid(i, c.Name, v)
+		}
+
+		existing, err := models.Characters.GetByName(ctx, c.Name)
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			if err := models.Characters.Insert(ctx, character); err != nil {
+				return err
+			}
+			counts.Created++
+			continue
+		case err != nil:
+			return err
+		}
+
+		if existing.Name == c.Name && existing.Age == c.Age && existing.Gender == c.Gender &&
+			existing.Status == c.Status && existing.Nation == c.Nation {
+			counts.Skipped++
+			continue
+		}
+
+		character.ID, character.UpdatedAt = existing.ID, existing.UpdatedAt
+		if err := models.Characters.Update(ctx, character); err != nil {
+			return err
+		}
+		counts.Updated++
+	}
+	return nil
+}
+
+func seedEpisodes(ctx context.Context, models model.Models, episodes []Episode, counts *Counts) error {
+	for i, e := range episodes {
+		episode := &model.Episode{Title: e.Title, Air_Date: e.AirDate}
+
+		v := validator.New()
+		model.ValidateEpisode(v, episode)
+		_, err := time.Parse("2006-01-02", e.AirDate)
+		v.Check(err == nil, "air_date", "must be a date in the YYYY-MM-DD format")
+		if !v.Valid() {
+			return invalid(i, e.Title, v)
+		}
+
+		existing, err := models.Episodes.GetByTitle(ctx, e.Title)
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			if err := models.Episodes.Insert(ctx, episode); err != nil {
+				return err
+			}
+			counts.Created++
+			continue
+		case err != nil:
+			return err
+		}
+
+		// Dates are read back as timestamps, e.g. 2005-02-21T00:00:00Z.
+		if strings.HasPrefix(existing.Air_Date, e.AirDate) {
+			counts.Skipped++
+			continue
+		}
+
+		episode.ID, episode.UpdatedAt = existing.ID, existing.UpdatedAt
+		if err := models.Episodes.Update(ctx, episode); err != nil {
+			return err
+		}
+		counts.Updated++
+	}
+	return nil
+}
+
+// seedQuotes upserts the quotes and links them to their characters. A quote that exists but
+// isn't linked yet counts as updated.
+func seedQuotes(ctx context.Context, models model.Models, quotes []Quote, counts *Counts) error {
+	for i, q := range quotes {
+		quote := &model.Quote{Quote: q.Quote}
+
+		v := validator.New()
+		if model.ValidateQuote(v, quote); !v.Valid() {
+			return invalid(i, q.Quote, v)
+		}
+
+		var character *model.Character
+		if q.Character != "" {
+			var err error
+			character, err = models.Characters.GetByName(ctx, q.Character)
+			if errors.Is(err, model.ErrRecordNotFound) {
+				return fmt.Errorf("quote %d: unknown character %q", i+1, q.Character)
+			} else if err != nil {
+				return err
+			}
+		}
+
+		existing, err := models.Quotes.GetByText(ctx, q.Quote)
+		created := false
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			if err := models.Quotes.Insert(ctx, quote); err != nil {
+				return err
+			}
+			created = true
+		case err != nil:
+			return err
+		default:
+			quote = existing
+		}
+
+		linked := character == nil
+		if !linked && !created {
+			said, err := models.Quotes.GetQuotesByCharacterID(ctx, character.ID)
+			if err != nil {
+				return err
+			}
+			for _, s := range said {
+				linked = linked || s.ID == quote.ID
+			}
+		}
+		if !linked {
+			if err := models.Characters.LinkQuote(ctx, character.ID, quote.ID); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case created:
+			counts.Created++
+		case !linked:
+			counts.Updated++
+		default:
+			counts.Skipped++
+		}
+	}
+	return nil
+}
+
+func seedAppearances(ctx context.Context, models model.Models, appearances []Appearance, counts *Counts) error {
+	for i, a := range appearances {
+		character, err := models.Characters.GetByName(ctx, a.Character)
+		if errors.Is(err, model.ErrRecordNotFound) {
+			return fmt.Errorf("appearance %d: unknown character %q", i+1, a.Character)
+		} else if err != nil {
+			return err
+		}
+
+		episode, err := models.Episodes.GetByTitle(ctx, a.Episode)
+		if errors.Is(err, model.ErrRecordNotFound) {
+			return fmt.Errorf("appearance %d: unknown episode %q", i+1, a.Episode)
+		} else if err != nil {
+			return err
+		}
+
+		cast, err := models.Characters.GetByEpisode(ctx, episode.ID)
+		if err != nil {
+			return err
+		}
+
+		linked := false
+		for _, c := range cast {
+			linked = linked || c.ID == character.ID
+		}
+		if linked {
+			counts.Skipped++
+			continue
+		}
+
+		if err := models.Characters.LinkEpisode(ctx, character.ID, episode.ID); err != nil {
+			return err
+		}
+		counts.Created++
+	}
+	return nil
+}
+
+// invalid describes the validation errors of the i-th record of a resource.
+func invalid(i int, key string, v *validator.Validator) error {
+	return fmt.Errorf("record %d (%q) is invalid: %s", i+1, key, v.Summary())
+}
@@ -0,0 +1,300 @@
+// Package jobs runs background work from a queue kept in the jobs table of the database.
+//
+// A job has a kind, which names the Go function that runs it, and a JSON payload with the
+// arguments of that function. Workers, in this process and in every other instance sharing the
+// database, claim runnable jobs with SELECT ... FOR UPDATE SKIP LOCKED, so that each job is run by
+// a single worker at a time. A job which fails is retried with an exponential backoff until it
+// has used up its attempts, and is then left dead in the table, where it can be inspected and
+// retried by hand.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/justverena/ATLA/pkg/atla/model"
+	"github.com/justverena/ATLA/pkg/jsonlog"
+)
+
+// Options configure a kind of job.
+type Options struct {
+	// MaxAttempts is how many times a job is run before it is dead, 5 if zero.
+	MaxAttempts int
+	// Timeout bounds a single run of a job, DefaultTimeout if zero.
+	Timeout time.Duration
+}
+
+// DefaultTimeout is the timeout of the kinds of job whose Options don't set one.
+const DefaultTimeout = time.Minute
+
+const (
+	defaultMaxAttempts = 5
+
+	// leaseMargin is added to the timeout of a kind to get how long a claimed job stays locked,
+	// so that a job isn't claimed again while its worker is still recording the outcome.
+	leaseMargin = 30 * time.Second
+)
+
+// kind is a registered kind of job.
+type kind struct {
+	opts   Options
+	handle func(ctx context.Context, payload json.RawMessage) error
+}
+
+// Queue enqueues jobs and runs them. Register the kinds of job before calling Run.
+type Queue struct {
+	Jobs   model.JobModel
+	Logger *jsonlog.Logger
+
+	// Workers is the number of jobs run at the same time by Run.
+	Workers int
+	// Poll is how often an idle worker looks for runnable jobs. Jobs enqueued by this process
+	// wake a worker up straight away.
+	Poll time.Duration
+	// Backoff returns how long to wait before retrying a job which failed attempt times.
+	Backoff func(attempt int) time.Duration
+
+	mu    sync.RWMutex
+	kinds map[string]kind
+	wake  chan struct{}
+}
+
+// New returns a queue storing its jobs with the given model, with 2 workers polling every second
+// and the default backoff.
+func New(jobs model.JobModel, logger *jsonlog.Logger) *Queue {
+	return &Queue{
+		Jobs:    jobs,
+		Logger:  logger,
+		Workers: 2,
+		Poll:    time.Second,
+		Backoff: DefaultBackoff,
+		kinds:   make(map[string]kind),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// DefaultBackoff waits 10 seconds after the first failure and twice as long after each of the
+// following ones, up to an hour. The delays are jittered so that jobs which failed together, for
+// example during a database outage, aren't all retried at the same moment.
+func DefaultBackoff(attempt int) time.Duration {
+	d := time.Hour
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt < 10 {
+		d = min(10*time.Second<<(attempt-1), time.Hour)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// Register makes fn the handler of the jobs of kind name, whose payloads are decoded into a T.
+// It panics if name is already registered.
+func Register[T any](q *Queue, name string, opts Options, fn func(ctx context.Context, payload T) error) {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.kinds[name]; ok {
+		panic("jobs: kind " + name + " registered twice")
+	}
+	q.kinds[name] = kind{
+		opts: opts,
+		handle: func(ctx context.Context, payload json.RawMessage) error {
+			var p T
+			if err := json.Unmarshal(payload, &p); err != nil {
+				// Retrying won't make the payload any more valid.
+				return Permanent(fmt.Errorf("decoding payload: %w", err))
+			}
+			return fn(ctx, p)
+		},
+	}
+}
+
+// permanentError is a failure that retrying won't fix.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that a job failing with it is dead straight away instead of being
+// retried.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Enqueue adds a job of the given kind, to be run as soon as a worker is free.
+func (q *Queue) Enqueue(ctx context.Context, kind string, payload interface{}) (*model.Job, error) {
+	return q.EnqueueAt(ctx, kind, payload, time.Time{})
+}
+
+// EnqueueIn adds a job of the given kind, to be run once delay has passed.
+func (q *Queue) EnqueueIn(ctx context.Context, kind string, payload interface{}, delay time.Duration) (*model.Job, error) {
+	return q.EnqueueAt(ctx, kind, payload, time.Now().Add(delay))
+}
+
+// EnqueueAt adds a job of the given kind, to be run at t, or straight away if t is zero. payload
+// is encoded as JSON.
+func (q *Queue) EnqueueAt(ctx context.Context, kind string, payload interface{}, t time.Time) (*model.Job, error) {
+	k, ok := q.kind(kind)
+	if !ok {
+		return nil, fmt.Errorf("unknown job kind %q", kind)
+	}
+
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &model.Job{
+		Kind:        kind,
+		Payload:     js,
+		MaxAttempts: k.opts.MaxAttempts,
+		RunAt:       t,
+	}
+	if err := q.Jobs.Insert(ctx, job); err != nil {
+		return nil, err
+	}
+
+	if !job.RunAt.After(time.Now()) {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	return job, nil
+}
+
+func (q *Queue) kind(name string) (kind, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	k, ok := q.kinds[name]
+	return k, ok
+}
+
+// Run runs jobs of the registered kinds with q.Workers workers until ctx is cancelled, and then
+// waits for the jobs being run to finish. Those aren't cancelled along with ctx: they have the
+// timeout of their kind to finish, so that a shutdown doesn't make them fail halfway.
+func (q *Queue) Run(ctx context.Context) {
+	q.mu.RLock()
+	leases := make(map[string]time.Duration, len(q.kinds))
+	for name, k := range q.kinds {
+		leases[name] = k.opts.Timeout + leaseMargin
+	}
+	q.mu.RUnlock()
+
+	if len(leases) == 0 || q.Workers < 1 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < q.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx, leases)
+		}()
+	}
+	wg.Wait()
+}
+
+// work claims and runs jobs one at a time until ctx is cancelled.
+func (q *Queue) work(ctx context.Context, leases map[string]time.Duration) {
+	for ctx.Err() == nil {
+		job, err := q.Jobs.Claim(ctx, leases)
+		switch {
+		case err == nil:
+			q.run(job)
+			continue
+		case ctx.Err() != nil:
+			return
+		case !errors.Is(err, model.ErrRecordNotFound):
+			q.Logger.PrintError(fmt.Errorf("claiming job: %w", err), nil)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-q.wake:
+		case <-time.After(q.Poll):
+		}
+	}
+}
+
+// run runs a claimed job and records the outcome.
+func (q *Queue) run(job *model.Job) {
+	k, _ := q.kind(job.Kind)
+	started := time.Now()
+
+	var err error
+	if job.Attempts > job.MaxAttempts {
+		// The job was claimed again after the lease of its last attempt expired, most likely
+		// because the process running it died.
+		err = Permanent(errors.New("lease of the last attempt expired"))
+	} else {
+		err = q.call(k, job)
+	}
+
+	properties := map[string]string{
+		"job_id":   strconv.FormatInt(job.ID, 10),
+		"kind":     job.Kind,
+		"attempt":  strconv.Itoa(job.Attempts),
+		"duration": time.Since(started).Round(time.Millisecond).String(),
+	}
+
+	// The outcome is recorded even when the queue is being stopped.
+	ctx := context.Background()
+
+	var permanent permanentError
+	switch {
+	case err == nil:
+		err = q.Jobs.Complete(ctx, job)
+		if err == nil {
+			q.Logger.PrintInfo("job succeeded", properties)
+		}
+	case errors.As(err, &permanent) || job.Attempts >= job.MaxAttempts:
+		properties["status"] = model.JobDead
+		q.Logger.PrintError(err, properties)
+		err = q.Jobs.Fail(ctx, job, err.Error(), nil)
+	default:
+		retryAt := time.Now().Add(q.Backoff(job.Attempts))
+		properties["status"] = model.JobPending
+		properties["retry_at"] = retryAt.UTC().Format(time.RFC3339)
+		q.Logger.PrintError(err, properties)
+		err = q.Jobs.Fail(ctx, job, err.Error(), &retryAt)
+	}
+
+	switch {
+	case errors.Is(err, model.ErrEditConflict):
+		q.Logger.PrintError(errors.New("job lease expired before its outcome was recorded"), properties)
+	case err != nil:
+		q.Logger.PrintError(fmt.Errorf("recording job outcome: %w", err), properties)
+	}
+}
+
+// call runs the handler of a job, turning a panic into an error.
+func (q *Queue) call(k kind, job *model.Job) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), k.opts.Timeout)
+	defer cancel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return k.handle(ctx, job.Payload)
+}
@@ -0,0 +1,206 @@
+// Package leader elects a single leader among the instances sharing a database, with a
+// PostgreSQL session-level advisory lock.
+//
+// Each instance tries to take the lock on a connection of its own. The instance that gets it
+// is the leader for as long as it keeps that connection, and the others keep trying. The lock
+// belongs to the database session, so when the leader stops, crashes or loses its connection,
+// PostgreSQL releases it and another instance takes over.
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/justverena/ATLA/pkg/jsonlog"
+)
+
+// checkTimeout bounds the check of the leader's connection. The lock is gone as soon as the
+// session ends, so a connection that doesn't answer quickly is given up rather than waited for,
+// to keep short the time during which a new leader and the old one both lead.
+const checkTimeout = time.Second
+
+// Status describes the leadership of this instance.
+type Status struct {
+	Name   string `json:"name"`
+	Leader bool   `json:"leader"`
+	// Since is when this instance became the leader, or stopped being it. It is nil until the
+	// first election this instance wins.
+	Since *time.Time `json:"since"`
+	// Elections is how many times this instance became the leader.
+	Elections int64 `json:"elections"`
+}
+
+// Elector takes part in the election of name.
+type Elector struct {
+	DB     *sql.DB
+	Logger *jsonlog.Logger
+
+	// Interval is how often a follower tries to become the leader, and how often the leader
+	// checks that its connection, and therefore its lock, is still alive.
+	Interval time.Duration
+
+	name string
+	key  int64
+
+	mu     sync.Mutex
+	status Status
+}
+
+// New returns an elector for the election of name, checking every 5 seconds. Instances take
+// part in the same election when they use the same name.
+func New(db *sql.DB, name string, logger *jsonlog.Logger) *Elector {
+	h := fnv.New64a()
+	h.Write([]byte("atla leader " + name))
+
+	return &Elector{
+		DB:       db,
+		Logger:   logger,
+		Interval: 5 * time.Second,
+		name:     name,
+		key:      int64(h.Sum64()),
+		status:   Status{Name: name},
+	}
+}
+
+// Status returns the leadership of this instance.
+func (e *Elector) Status() Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.status
+}
+
+// IsLeader reports whether this instance is the leader.
+func (e *Elector) IsLeader() bool {
+	return e.Status().Leader
+}
+
+func (e *Elector) setLeader(leader bool) {
+	now := time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.status.Leader = leader
+	e.status.Since = &now
+	if leader {
+		e.status.Elections++
+	}
+}
+
+// Run takes part in the election until ctx is cancelled. Whenever this instance becomes the
+// leader, lead is called with a context which is cancelled when the leadership is lost or given
+// up. The lock is only released once lead has returned, so that two instances never lead at the
+// same time, as long as lead stops when its context is cancelled.
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	for {
+		conn, err := e.acquire(ctx)
+		switch {
+		case conn != nil:
+			e.lead(ctx, conn, lead)
+		case err != nil && ctx.Err() == nil:
+			e.Logger.PrintError(err, map[string]string{
+				"election": e.name,
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.Interval):
+		}
+	}
+}
+
+// acquire returns a connection holding the lock, or nil if another instance holds it.
+func (e *Elector) acquire(ctx context.Context) (*sql.Conn, error) {
+	conn, err := e.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var acquired bool
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, e.key).Scan(&acquired)
+	switch {
+	case err != nil:
+		// The lock may have been taken before the error, so the session is ended to be sure.
+		discard(conn)
+		return nil, err
+	case !acquired:
+		conn.Close()
+		return nil, nil
+	}
+
+	return conn, nil
+}
+
+// lead runs lead while conn is alive and ctx isn't cancelled, and then releases the lock.
+func (e *Elector) lead(ctx context.Context, conn *sql.Conn, lead func(ctx context.Context)) {
+	defer discard(conn)
+
+	e.setLeader(true)
+	e.Logger.PrintInfo("became leader", map[string]string{
+		"election": e.name,
+	})
+
+	leadCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lead(leadCtx)
+	}()
+
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	var lost error
+	for lost == nil && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+			lost = e.check(ctx, conn)
+		}
+	}
+
+	cancel()
+	<-done
+
+	e.setLeader(false)
+	if lost != nil {
+		e.Logger.PrintError(errors.New("lost leadership"), map[string]string{
+			"election": e.name,
+			"cause":    lost.Error(),
+		})
+	} else {
+		e.Logger.PrintInfo("gave up leadership", map[string]string{
+			"election": e.name,
+		})
+	}
+}
+
+// check returns an error if the connection holding the lock is gone or doesn't answer within
+// checkTimeout.
+func (e *Elector) check(ctx context.Context, conn *sql.Conn) error {
+	ctx, cancel := context.WithTimeout(ctx, min(checkTimeout, e.Interval))
+	defer cancel()
+
+	_, err := conn.ExecContext(ctx, `SELECT 1`)
+	if ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		// Cancelled by the shutdown rather than a failure.
+		return nil
+	}
+	return err
+}
+
+// discard closes conn for good rather than returning it to the pool, which ends its database
+// session and releases the lock it holds.
+func discard(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+	conn.Close()
+}
@@ -0,0 +1,144 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/justverena/ATLA/pkg/jsonlog"
+	_ "github.com/lib/pq"
+)
+
+// testDSNEnv names the environment variable with the DSN of a PostgreSQL database for the
+// election tests, which are skipped when it isn't set.
+const testDSNEnv = "ATLA_TEST_DB_DSN"
+
+func TestElection(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s isn't set", testDSNEnv)
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A name of its own keeps the test out of the elections of other runs and of the API.
+	name := fmt.Sprintf("test %d", time.Now().UnixNano())
+	logger := jsonlog.NewLogger(io.Discard, jsonlog.LevelOff)
+
+	electors := make([]*Elector, 3)
+	for i := range electors {
+		electors[i] = New(db, name, logger)
+		electors[i].Interval = 50 * time.Millisecond
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	for _, e := range electors {
+		e := e
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.Run(ctx, func(ctx context.Context) { <-ctx.Done() })
+		}()
+	}
+
+	first := waitForLeader(t, db, electors, 0)
+
+	// A follower stays a follower while the leader is alive.
+	time.Sleep(10 * electors[0].Interval)
+	if leaders := countLeaders(electors); leaders != 1 {
+		t.Fatalf("%d electors lead, want 1", leaders)
+	}
+
+	// Ending the session of the leader releases the lock, and another session takes it over.
+	var terminated bool
+	err = db.QueryRow(`SELECT pg_terminate_backend($1)`, first).Scan(&terminated)
+	if err != nil || !terminated {
+		t.Fatalf("terminating the session of the leader: %v", err)
+	}
+	waitForLeader(t, db, electors, first)
+
+	cancel()
+	wg.Wait()
+
+	if leaders := countLeaders(electors); leaders != 0 {
+		t.Errorf("%d electors still lead after shutdown, want 0", leaders)
+	}
+
+	// The session of the leader is ended on shutdown, and the server releases the lock once its
+	// process has noticed.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pid, err := lockHolder(db, electors[0].key)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if err != nil || time.Now().After(deadline) {
+			t.Fatalf("the lock is still held by session %d after shutdown (%v)", pid, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForLeader waits until exactly one elector leads, with the lock held by a session other
+// than previous, and returns the process ID of that session.
+func waitForLeader(t *testing.T, db *sql.DB, electors []*Elector, previous int) int {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		pid, err := lockHolder(db, electors[0].key)
+		if err == nil && pid != previous && countLeaders(electors) == 1 {
+			return pid
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("%d electors lead, want 1 on a session other than %d", countLeaders(electors), previous)
+	return 0
+}
+
+func countLeaders(electors []*Elector) int {
+	n := 0
+	for _, e := range electors {
+		if e.IsLeader() {
+			n++
+		}
+	}
+	return n
+}
+
+// lockHolder returns the process ID of the session holding the advisory lock of key. A bigint
+// key is split into the classid and objid columns of pg_locks.
+func lockHolder(db *sql.DB, key int64) (int, error) {
+	var pid int
+	err := db.QueryRow(`
+		SELECT pid
+		FROM pg_locks
+		WHERE locktype = 'advisory' AND granted AND objsubid = 1
+			AND database = (SELECT oid FROM pg_database WHERE datname = current_database())
+			AND classid::bigint = $1 AND objid::bigint = $2`,
+		int64(uint64(key)>>32), int64(uint32(key))).Scan(&pid)
+	return pid, err
+}
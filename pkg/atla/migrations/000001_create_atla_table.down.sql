@@ -1,5 +1,5 @@
 DROP TABLE IF EXISTS characters_and_episodes;
+DROP TABLE IF EXISTS characters_and_quotes;
 DROP TABLE IF EXISTS characters;
 DROP TABLE IF EXISTS episodes;
 DROP TABLE IF EXISTS quotes;
-DROP TABLE IF EXISTS characters_and_quotes;
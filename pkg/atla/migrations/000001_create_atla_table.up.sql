@@ -16,15 +16,15 @@ CREATE TABLE IF NOT EXISTS episodes
     title           text                        NOT NULL,
     air_date        date                        NOT NULL,
     created_at      timestamp(0) with time zone NOT NULL DEFAULT NOW(),
-    updated_at      timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at      timestamp(0) with time zone NOT NULL DEFAULT NOW()
 );
 
 CREATE TABLE IF NOT EXISTS quotes
 (
     id              bigserial PRIMARY KEY,
-    qoute           text                        NOT NULL,
+    quote           text                        NOT NULL,
     created_at      timestamp(0) with time zone NOT NULL DEFAULT NOW(),
-    updated_at      timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at      timestamp(0) with time zone NOT NULL DEFAULT NOW()
 );
 CREATE TABLE IF NOT EXISTS characters_and_episodes
 (
@@ -48,6 +48,6 @@ CREATE TABLE IF NOT EXISTS characters_and_quotes
     updated_at       timestamp(0) with time zone NOT NULL DEFAULT NOW(),
     FOREIGN KEY (character_id)
         REFERENCES characters(id),
-    FOREIGN KEY (qoute_id)
+    FOREIGN KEY (quote_id)
         REFERENCES quotes(id)
 );
\ No newline at end of file
@@ -0,0 +1,11 @@
+ALTER TABLE characters_and_episodes
+    DROP CONSTRAINT characters_and_episodes_character_id_fkey,
+    DROP CONSTRAINT characters_and_episodes_episode_id_fkey,
+    ADD FOREIGN KEY (character_id) REFERENCES characters(id),
+    ADD FOREIGN KEY (episode_id) REFERENCES episodes(id);
+
+ALTER TABLE characters_and_quotes
+    DROP CONSTRAINT characters_and_quotes_character_id_fkey,
+    DROP CONSTRAINT characters_and_quotes_quote_id_fkey,
+    ADD FOREIGN KEY (character_id) REFERENCES characters(id),
+    ADD FOREIGN KEY (quote_id) REFERENCES quotes(id);
@@ -0,0 +1,13 @@
+-- Deleting a character, an episode or a quote removes its links, instead of failing while it
+-- has any.
+ALTER TABLE characters_and_episodes
+    DROP CONSTRAINT characters_and_episodes_character_id_fkey,
+    DROP CONSTRAINT characters_and_episodes_episode_id_fkey,
+    ADD FOREIGN KEY (character_id) REFERENCES characters(id) ON DELETE CASCADE,
+    ADD FOREIGN KEY (episode_id) REFERENCES episodes(id) ON DELETE CASCADE;
+
+ALTER TABLE characters_and_quotes
+    DROP CONSTRAINT characters_and_quotes_character_id_fkey,
+    DROP CONSTRAINT characters_and_quotes_quote_id_fkey,
+    ADD FOREIGN KEY (character_id) REFERENCES characters(id) ON DELETE CASCADE,
+    ADD FOREIGN KEY (quote_id) REFERENCES quotes(id) ON DELETE CASCADE;
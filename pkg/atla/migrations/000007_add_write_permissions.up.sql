@@ -0,0 +1,3 @@
+INSERT INTO permissions (code)
+VALUES ('episodes:write'),
+       ('quotes:write');
\ No newline at end of file
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS jobs
+(
+	id           BIGSERIAL PRIMARY KEY,
+	kind         TEXT                        NOT NULL,
+	payload      JSONB                       NOT NULL DEFAULT '{}',
+	status       TEXT                        NOT NULL DEFAULT 'pending',
+	attempts     INTEGER                     NOT NULL DEFAULT 0,
+	max_attempts INTEGER                     NOT NULL DEFAULT 5,
+	run_at       TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	locked_until TIMESTAMP(0) WITH TIME ZONE,
+	last_error   TEXT                        NOT NULL DEFAULT '',
+	created_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	updated_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS jobs_runnable_idx ON jobs (run_at, id) WHERE status IN ('pending', 'running');
+
+INSERT INTO permissions (code)
+VALUES ('jobs:read'),
+       ('jobs:write');
@@ -0,0 +1,8 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS activated_at TIMESTAMP(0) WITH TIME ZONE;
+
+-- When the existing users were activated isn't known. Those who are activated, or who were
+-- changed after registering and so may have been activated and deactivated since, are taken to
+-- be activated when they registered, so that the purge of unactivated users leaves them alone.
+UPDATE users
+SET activated_at = created_at
+WHERE activated OR version > 1;
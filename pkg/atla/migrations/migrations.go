@@ -0,0 +1,480 @@
+// Package migrations embeds the SQL migrations of the database schema and applies them.
+//
+// Migrations are pairs of files named <version>_<name>.up.sql and <version>_<name>.down.sql.
+// The applied version is kept in schema_migrations, in the same layout as golang-migrate, so that
+// databases migrated with its CLI can be managed with this package and the other way around.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// embedded are the migrations built into the binary, in version order.
+var embedded = mustLoad(files)
+
+// lockID is the key of the advisory lock which stops two processes, for example two instances
+// started with -migrate-on-start, from migrating the database at the same time.
+const lockID = 7_305_221_640_193_478
+
+var (
+	// ErrDirty is returned when a migration was interrupted by a tool that doesn't run
+	// migrations in transactions. The schema has to be repaired by hand and the version set with
+	// Force.
+	ErrDirty = errors.New("database is dirty")
+
+	// ErrUnknownVersion is returned when the database is at, or asked to go to, a version that
+	// has no migration.
+	ErrUnknownVersion = errors.New("unknown migration version")
+)
+
+// Migration is an up and down SQL script pair.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Step is a migration that was applied in one direction.
+type Step struct {
+	Version   int           `json:"version"`
+	Name      string        `json:"name"`
+	Direction string        `json:"direction"`
+	Duration  time.Duration `json:"-"`
+}
+
+// Status is the state of the database schema.
+type Status struct {
+	Version    int               `json:"version"`
+	Dirty      bool              `json:"dirty"`
+	Latest     int               `json:"latest"`
+	Migrations []MigrationStatus `json:"migrations"`
+}
+
+// MigrationStatus tells whether a migration is applied.
+type MigrationStatus struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	Applied bool   `json:"applied"`
+}
+
+var fileRX = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads the migrations in the root of fsys. Every version must have both an up and a down
+// script.
+func Load(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, name := range names {
+		match := fileRX.FindStringSubmatch(path.Base(name))
+		if match == nil {
+			return nil, fmt.Errorf("migration %s: name must be <version>_<name>.up.sql or .down.sql", name)
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s: invalid version", name)
+		}
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %s: version %d is also used by %s", name, version, m.Name)
+		}
+
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s: both the up and the down script are required", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+func mustLoad(fsys fs.FS) []Migration {
+	migrations, err := Load(fsys)
+	if err != nil {
+		panic(err)
+	}
+	return migrations
+}
+
+// Latest returns the version of the last embedded migration, which is the schema version the
+// binary expects.
+func Latest() int {
+	if len(embedded) == 0 {
+		return 0
+	}
+	return embedded[len(embedded)-1].Version
+}
+
+// Versions returns the versions of the embedded migrations, in order.
+func Versions() []int {
+	versions := make([]int, len(embedded))
+	for i, mig := range embedded {
+		versions[i] = mig.Version
+	}
+	return versions
+}
+
+// Migrator applies migrations to a database.
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+}
+
+// New returns a Migrator for the embedded migrations.
+func New(db *sql.DB) *Migrator {
+	return &Migrator{DB: db, Migrations: embedded}
+}
+
+// Up applies the next n pending migrations, or all of them if n is zero or less.
+func (m *Migrator) Up(ctx context.Context, n int) ([]Step, error) {
+	var steps []Step
+
+	err := m.locked(ctx, func(conn *sql.Conn, current int) error {
+		i, err := m.index(current)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.Migrations[i+1:] {
+			if n > 0 && len(steps) == n {
+				break
+			}
+			step, err := m.apply(ctx, conn, mig, "up", mig.Version)
+			if err != nil {
+				return err
+			}
+			steps = append(steps, step)
+		}
+		return nil
+	})
+
+	return steps, err
+}
+
+// UpTx applies every pending migration in tx, so that they are committed or rolled back along
+// with the rest of the transaction. The migration lock is held until tx ends.
+func (m *Migrator) UpTx(ctx context.Context, tx *sql.Tx) ([]Step, error) {
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, lockID)
+	if err != nil {
+		return nil, fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, createVersionTable); err != nil {
+		return nil, err
+	}
+
+	current, dirty, err := currentVersion(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if dirty {
+		return nil, fmt.Errorf("%w at version %d: repair the schema, then run force", ErrDirty, current)
+	}
+	i, err := m.index(current)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []Step
+	for _, mig := range m.Migrations[i+1:] {
+		start := time.Now()
+		if _, err := tx.ExecContext(ctx, mig.Up); err != nil {
+			return nil, fmt.Errorf("migration %d_%s up: %w", mig.Version, mig.Name, err)
+		}
+		steps = append(steps, Step{Version: mig.Version, Name: mig.Name, Direction: "up", Duration: time.Since(start)})
+	}
+	if len(steps) > 0 {
+		if err := setVersion(ctx, tx, steps[len(steps)-1].Version); err != nil {
+			return nil, err
+		}
+	}
+
+	return steps, nil
+}
+
+// Down reverts the last n applied migrations, or all of them if n is zero or less.
+func (m *Migrator) Down(ctx context.Context, n int) ([]Step, error) {
+	var steps []Step
+
+	err := m.locked(ctx, func(conn *sql.Conn, current int) error {
+		i, err := m.index(current)
+		if err != nil {
+			return err
+		}
+
+		for ; i >= 0; i-- {
+			if n > 0 && len(steps) == n {
+				break
+			}
+			step, err := m.apply(ctx, conn, m.Migrations[i], "down", m.previous(i))
+			if err != nil {
+				return err
+			}
+			steps = append(steps, step)
+		}
+		return nil
+	})
+
+	return steps, err
+}
+
+// Goto migrates up or down to version. Version 0 reverts every migration.
+func (m *Migrator) Goto(ctx context.Context, version int) ([]Step, error) {
+	target, err := m.index(version)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []Step
+
+	err = m.locked(ctx, func(conn *sql.Conn, current int) error {
+		i, err := m.index(current)
+		if err != nil {
+			return err
+		}
+
+		for ; i < target; i++ {
+			mig := m.Migrations[i+1]
+			step, err := m.apply(ctx, conn, mig, "up", mig.Version)
+			if err != nil {
+				return err
+			}
+			steps = append(steps, step)
+		}
+		for ; i > target; i-- {
+			step, err := m.apply(ctx, conn, m.Migrations[i], "down", m.previous(i))
+			if err != nil {
+				return err
+			}
+			steps = append(steps, step)
+		}
+		return nil
+	})
+
+	return steps, err
+}
+
+// Force sets the version of the database without running any migration, and clears the dirty
+// flag. It is used after repairing the schema by hand.
+func (m *Migrator) Force(ctx context.Context, version int) error {
+	if _, err := m.index(version); err != nil {
+		return err
+	}
+
+	conn, err := m.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.release(conn)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setVersion(ctx, tx, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Status returns the current version and the migrations which are applied.
+func (m *Migrator) Status(ctx context.Context) (Status, error) {
+	var status Status
+	if len(m.Migrations) > 0 {
+		status.Latest = m.Migrations[len(m.Migrations)-1].Version
+	}
+
+	conn, err := m.conn(ctx)
+	if err != nil {
+		return status, err
+	}
+	defer m.release(conn)
+
+	status.Version, status.Dirty, err = currentVersion(ctx, conn)
+	if err != nil {
+		return status, err
+	}
+
+	for _, mig := range m.Migrations {
+		status.Migrations = append(status.Migrations, MigrationStatus{
+			Version: mig.Version,
+			Name:    mig.Name,
+			Applied: mig.Version <= status.Version,
+		})
+	}
+	return status, nil
+}
+
+// locked runs fn with a connection holding the migration lock, and the current version of the
+// database. It refuses to run if the database is dirty.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn, current int) error) error {
+	conn, err := m.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.release(conn)
+
+	current, dirty, err := currentVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("%w at version %d: repair the schema, then run force", ErrDirty, current)
+	}
+
+	return fn(conn, current)
+}
+
+// conn takes a connection from the pool, makes sure schema_migrations exists and acquires the
+// migration lock, waiting for another migrating process to finish if needed. The lock belongs
+// to the session, so every statement has to run on this connection.
+func (m *Migrator) conn(ctx context.Context) (*sql.Conn, error) {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("acquiring migration lock: %w", err)
+	}
+
+	_, err = conn.ExecContext(ctx, createVersionTable)
+	if err != nil {
+		m.release(conn)
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// release unlocks and returns the connection to the pool. It uses a fresh context, so that the
+// lock is released even when ctx was cancelled.
+func (m *Migrator) release(conn *sql.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockID)
+	conn.Close()
+}
+
+// apply runs one script of mig, and records the resulting version in the same transaction, so
+// that a failing migration leaves neither the schema nor the version changed.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, mig Migration, direction string, to int) (Step, error) {
+	start := time.Now()
+	script := mig.Up
+	if direction == "down" {
+		script = mig.Down
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return Step{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return Step{}, fmt.Errorf("migration %d_%s %s: %w", mig.Version, mig.Name, direction, err)
+	}
+	if err := setVersion(ctx, tx, to); err != nil {
+		return Step{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Step{}, err
+	}
+
+	return Step{Version: mig.Version, Name: mig.Name, Direction: direction, Duration: time.Since(start)}, nil
+}
+
+// index returns the position of version in m.Migrations, or -1 for version 0.
+func (m *Migrator) index(version int) (int, error) {
+	if version == 0 {
+		return -1, nil
+	}
+	for i, mig := range m.Migrations {
+		if mig.Version == version {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w %d", ErrUnknownVersion, version)
+}
+
+// previous returns the version before the migration at position i.
+func (m *Migrator) previous(i int) int {
+	if i == 0 {
+		return 0
+	}
+	return m.Migrations[i-1].Version
+}
+
+// createVersionTable creates schema_migrations, which holds the version of the database.
+const createVersionTable = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint  NOT NULL PRIMARY KEY,
+		dirty   boolean NOT NULL
+	)`
+
+// currentVersion reads the version of the database. A database without migrations is at version 0.
+func currentVersion(ctx context.Context, conn interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}) (int, bool, error) {
+	var version int
+	var dirty bool
+
+	err := conn.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+// setVersion replaces the row of schema_migrations. Version 0 leaves the table empty.
+func setVersion(ctx context.Context, tx *sql.Tx, version int) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil || version == 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, version)
+	return err
+}
@@ -0,0 +1,468 @@
+package model
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStats are the counters reported by Cache.Stats.
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+}
+
+// Cache is a size-bounded LRU cache whose entries expire after a TTL. Concurrent misses for the
+// same key are collapsed, so that only one of them runs the database query while the others wait
+// for its result.
+type Cache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+	calls map[string]*cacheCall
+
+	// generation is incremented by every invalidation. A load that started before an
+	// invalidation may have read the old rows, so its result isn't stored.
+	generation uint64
+
+	stats CacheStats
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// cacheCall is a load in progress. done is closed when it completes.
+type cacheCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// NewCache returns a cache holding at most size entries for up to ttl each.
+func NewCache(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+		calls: make(map[string]*cacheCall),
+	}
+}
+
+// load returns the cached value of key, or calls fn to load it. Errors aren't cached. Other
+// callers may be waiting for the result of fn, so it runs with a context that isn't cancelled
+// along with ctx. A caller whose ctx is done stops waiting, though.
+func (c *Cache) load(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.ll.MoveToFront(el)
+			c.stats.Hits++
+			c.mu.Unlock()
+			return entry.value, nil
+		}
+		c.removeElement(el)
+	}
+
+	c.stats.Misses++
+
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.value, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	generation := c.generation
+	c.mu.Unlock()
+
+	call.value, call.err = fn(context.WithoutCancel(ctx))
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if call.err == nil && generation == c.generation {
+		c.add(key, call.value)
+	}
+	c.mu.Unlock()
+
+	close(call.done)
+	return call.value, call.err
+}
+
+// add stores a value, evicting the least recently used entry if the cache is full.
+func (c *Cache) add(key string, value interface{}) {
+	entry := &cacheEntry{key: key, value: value, expires: time.Now().Add(c.ttl)}
+
+	if el, ok := c.items[key]; ok {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(entry)
+
+	for c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+}
+
+// invalidate removes the entries with the given keys, and every entry whose key starts with one
+// of the prefixes.
+func (c *Cache) invalidate(keys []string, prefixes ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	for _, key := range keys {
+		if el, ok := c.items[key]; ok {
+			c.removeElement(el)
+		}
+	}
+
+	if len(prefixes) == 0 {
+		return
+	}
+	for key, el := range c.items {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				c.removeElement(el)
+				break
+			}
+		}
+	}
+}
+
+// Stats returns the hit, miss and eviction counters and the current number of entries.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.ll.Len()
+	return stats
+}
+
+// EnableCache wraps the character, episode and quote models with decorators which cache their
+// reads in c. The three share the cache, so that a write to one of them can invalidate the
+// related entries of the others (for example, the characters of an episode).
+func (m *Models) EnableCache(c *Cache) {
+	m.Characters = &CachedCharacterModel{CharacterStore: m.Characters, cache: c}
+	m.Episodes = &CachedEpisodeModel{EpisodeStore: m.Episodes, cache: c}
+	m.Quotes = &CachedQuoteModel{QuoteStore: m.Quotes, cache: c}
+}
+
+// Cache keys. Keys ending with ":" are prefixes of a family of keys.
+const (
+	keyCharacterLists    = "characters:list:"
+	keyEpisodeLists      = "episodes:list:"
+	keyQuoteLists        = "quotes:list:"
+	keyCharacters        = "character:"
+	keyEpisodes          = "episode:"
+	keyQuotes            = "quote:"
+	keyEpisodeCharacters = "episode-characters:"
+	keyCharacterEpisodes = "character-episodes:"
+	keyCharacterQuotes   = "character-quotes:"
+	keyQuoteCharacter    = "quote-character:"
+)
+
+func key(prefix string, id int) string {
+	return fmt.Sprintf("%s%d", prefix, id)
+}
+
+// The cached values are shared, and handlers modify the records they get before updating them,
+// so every read returns copies.
+
+func copyCharacter(c *Character) *Character {
+	if c == nil {
+		return nil
+	}
+	cp := *c
+	return &cp
+}
+
+func copyCharacters(characters []*Character) []*Character {
+	if characters == nil {
+		return nil
+	}
+	out := make([]*Character, len(characters))
+	for i, c := range characters {
+		out[i] = copyCharacter(c)
+	}
+	return out
+}
+
+func copyEpisode(e *Episode) *Episode {
+	if e == nil {
+		return nil
+	}
+	cp := *e
+	return &cp
+}
+
+func copyEpisodes(episodes []*Episode) []*Episode {
+	if episodes == nil {
+		return nil
+	}
+	out := make([]*Episode, len(episodes))
+	for i, e := range episodes {
+		out[i] = copyEpisode(e)
+	}
+	return out
+}
+
+func copyQuote(q *Quote) *Quote {
+	if q == nil {
+		return nil
+	}
+	cp := *q
+	return &cp
+}
+
+func copyQuotes(quotes []*Quote) []*Quote {
+	if quotes == nil {
+		return nil
+	}
+	out := make([]*Quote, len(quotes))
+	for i, q := range quotes {
+		out[i] = copyQuote(q)
+	}
+	return out
+}
+
+// listPage is a cached GetAll result.
+type listPage struct {
+	items    interface{}
+	metadata Metadata
+}
+
+// CachedCharacterModel caches the reads of a CharacterStore.
+type CachedCharacterModel struct {
+	CharacterStore
+	cache *Cache
+}
+
+func (m *CachedCharacterModel) GetAll(ctx context.Context, name string, ageFrom int, ageTo int, filters Filters) ([]*Character, Metadata, error) {
+	k := fmt.Sprintf("%s%q|%d|%d|%d|%d|%q", keyCharacterLists, name, ageFrom, ageTo, filters.Page, filters.PageSize, filters.Sort)
+
+	v, err := m.cache.load(ctx, k, func(ctx context.Context) (interface{}, error) {
+		characters, metadata, err := m.CharacterStore.GetAll(ctx, name, ageFrom, ageTo, filters)
+		return listPage{characters, metadata}, err
+	})
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	page := v.(listPage)
+	return copyCharacters(page.items.([]*Character)), page.metadata, nil
+}
+
+func (m *CachedCharacterModel) Get(ctx context.Context, id int) (*Character, error) {
+	v, err := m.cache.load(ctx, key(keyCharacters, id), func(ctx context.Context) (interface{}, error) {
+		return m.CharacterStore.Get(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyCharacter(v.(*Character)), nil
+}
+
+func (m *CachedCharacterModel) GetByEpisode(ctx context.Context, episodeID int) ([]*Character, error) {
+	v, err := m.cache.load(ctx, key(keyEpisodeCharacters, episodeID), func(ctx context.Context) (interface{}, error) {
+		return m.CharacterStore.GetByEpisode(ctx, episodeID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyCharacters(v.([]*Character)), nil
+}
+
+func (m *CachedCharacterModel) GetByQuote(ctx context.Context, quoteID int) (*Character, error) {
+	v, err := m.cache.load(ctx, key(keyQuoteCharacter, quoteID), func(ctx context.Context) (interface{}, error) {
+		return m.CharacterStore.GetByQuote(ctx, quoteID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyCharacter(v.(*Character)), nil
+}
+
+func (m *CachedCharacterModel) Insert(ctx context.Context, character *Character) error {
+	defer m.cache.invalidate(nil, keyCharacterLists)
+	return m.CharacterStore.Insert(ctx, character)
+}
+
+// Update invalidates the character and every list it may be part of.
+func (m *CachedCharacterModel) Update(ctx context.Context, character *Character) error {
+	defer m.cache.invalidate([]string{key(keyCharacters, character.ID)},
+		keyCharacterLists, keyEpisodeCharacters, keyQuoteCharacter)
+	return m.CharacterStore.Update(ctx, character)
+}
+
+// Delete also invalidates the relations of the character, since its join table rows go with it.
+func (m *CachedCharacterModel) Delete(ctx context.Context, id int) error {
+	defer m.cache.invalidate([]string{key(keyCharacters, id), key(keyCharacterEpisodes, id), key(keyCharacterQuotes, id)},
+		keyCharacterLists, keyEpisodeCharacters, keyQuoteCharacter)
+	return m.CharacterStore.Delete(ctx, id)
+}
+
+func (m *CachedCharacterModel) LinkEpisode(ctx context.Context, characterID, episodeID int) error {
+	defer m.cache.invalidate([]string{key(keyCharacterEpisodes, characterID), key(keyEpisodeCharacters, episodeID)})
+	return m.CharacterStore.LinkEpisode(ctx, characterID, episodeID)
+}
+
+func (m *CachedCharacterModel) UnlinkEpisode(ctx context.Context, characterID, episodeID int) error {
+	defer m.cache.invalidate([]string{key(keyCharacterEpisodes, characterID), key(keyEpisodeCharacters, episodeID)})
+	return m.CharacterStore.UnlinkEpisode(ctx, characterID, episodeID)
+}
+
+func (m *CachedCharacterModel) LinkQuote(ctx context.Context, characterID, quoteID int) error {
+	defer m.cache.invalidate([]string{key(keyCharacterQuotes, characterID), key(keyQuoteCharacter, quoteID)})
+	return m.CharacterStore.LinkQuote(ctx, characterID, quoteID)
+}
+
+func (m *CachedCharacterModel) UnlinkQuote(ctx context.Context, characterID, quoteID int) error {
+	defer m.cache.invalidate([]string{key(keyCharacterQuotes, characterID), key(keyQuoteCharacter, quoteID)})
+	return m.CharacterStore.UnlinkQuote(ctx, characterID, quoteID)
+}
+
+// CachedEpisodeModel caches the reads of an EpisodeStore.
+type CachedEpisodeModel struct {
+	EpisodeStore
+	cache *Cache
+}
+
+func (m *CachedEpisodeModel) GetAll(ctx context.Context, title string, filters Filters) ([]*Episode, Metadata, error) {
+	k := fmt.Sprintf("%s%q|%d|%d|%q", keyEpisodeLists, title, filters.Page, filters.PageSize, filters.Sort)
+
+	v, err := m.cache.load(ctx, k, func(ctx context.Context) (interface{}, error) {
+		episodes, metadata, err := m.EpisodeStore.GetAll(ctx, title, filters)
+		return listPage{episodes, metadata}, err
+	})
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	page := v.(listPage)
+	return copyEpisodes(page.items.([]*Episode)), page.metadata, nil
+}
+
+func (m *CachedEpisodeModel) Get(ctx context.Context, id int) (*Episode, error) {
+	v, err := m.cache.load(ctx, key(keyEpisodes, id), func(ctx context.Context) (interface{}, error) {
+		return m.EpisodeStore.Get(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyEpisode(v.(*Episode)), nil
+}
+
+func (m *CachedEpisodeModel) GetByCharacter(ctx context.Context, characterID int) ([]*Episode, error) {
+	v, err := m.cache.load(ctx, key(keyCharacterEpisodes, characterID), func(ctx context.Context) (interface{}, error) {
+		return m.EpisodeStore.GetByCharacter(ctx, characterID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyEpisodes(v.([]*Episode)), nil
+}
+
+// invalidateEpisodes drops every cached episode. Episodes carry the IDs of their neighbours in
+// air date order, so inserting, moving or deleting one changes others too.
+func (m *CachedEpisodeModel) invalidateEpisodes(extra ...string) {
+	m.cache.invalidate(extra, keyEpisodes, keyEpisodeLists, keyCharacterEpisodes)
+}
+
+func (m *CachedEpisodeModel) Insert(ctx context.Context, episode *Episode) error {
+	defer m.invalidateEpisodes()
+	return m.EpisodeStore.Insert(ctx, episode)
+}
+
+func (m *CachedEpisodeModel) Update(ctx context.Context, episode *Episode) error {
+	defer m.invalidateEpisodes()
+	return m.EpisodeStore.Update(ctx, episode)
+}
+
+func (m *CachedEpisodeModel) Delete(ctx context.Context, id int) error {
+	defer m.invalidateEpisodes(key(keyEpisodeCharacters, id))
+	return m.EpisodeStore.Delete(ctx, id)
+}
+
+// CachedQuoteModel caches the reads of a QuoteStore.
+type CachedQuoteModel struct {
+	QuoteStore
+	cache *Cache
+}
+
+func (m *CachedQuoteModel) GetAll(ctx context.Context, quote string, filters Filters) ([]*Quote, Metadata, error) {
+	k := fmt.Sprintf("%s%q|%d|%d|%q", keyQuoteLists, quote, filters.Page, filters.PageSize, filters.Sort)
+
+	v, err := m.cache.load(ctx, k, func(ctx context.Context) (interface{}, error) {
+		quotes, metadata, err := m.QuoteStore.GetAll(ctx, quote, filters)
+		return listPage{quotes, metadata}, err
+	})
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	page := v.(listPage)
+	return copyQuotes(page.items.([]*Quote)), page.metadata, nil
+}
+
+func (m *CachedQuoteModel) Get(ctx context.Context, id int) (*Quote, error) {
+	v, err := m.cache.load(ctx, key(keyQuotes, id), func(ctx context.Context) (interface{}, error) {
+		return m.QuoteStore.Get(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyQuote(v.(*Quote)), nil
+}
+
+func (m *CachedQuoteModel) GetQuotesByCharacterID(ctx context.Context, characterID int) ([]*Quote, error) {
+	v, err := m.cache.load(ctx, key(keyCharacterQuotes, characterID), func(ctx context.Context) (interface{}, error) {
+		return m.QuoteStore.GetQuotesByCharacterID(ctx, characterID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyQuotes(v.([]*Quote)), nil
+}
+
+func (m *CachedQuoteModel) Insert(ctx context.Context, quote *Quote) error {
+	defer m.cache.invalidate(nil, keyQuoteLists)
+	return m.QuoteStore.Insert(ctx, quote)
+}
+
+func (m *CachedQuoteModel) Update(ctx context.Context, quote *Quote) error {
+	defer m.cache.invalidate([]string{key(keyQuotes, quote.ID)}, keyQuoteLists, keyCharacterQuotes)
+	return m.QuoteStore.Update(ctx, quote)
+}
+
+func (m *CachedQuoteModel) Delete(ctx context.Context, id int) error {
+	defer m.cache.invalidate([]string{key(keyQuotes, id), key(keyQuoteCharacter, id)}, keyQuoteLists, keyCharacterQuotes)
+	return m.QuoteStore.Delete(ctx, id)
+}
@@ -0,0 +1,310 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	// A step reads key, after sleeping for sleep, and expects the read to run the loader or not.
+	type step struct {
+		key   string
+		sleep time.Duration
+		load  bool
+	}
+
+	tests := []struct {
+		name      string
+		size      int
+		ttl       time.Duration
+		steps     []step
+		evictions int64
+	}{
+		{
+			name: "hit",
+			size: 2,
+			ttl:  time.Minute,
+			steps: []step{
+				{key: "a", load: true},
+				{key: "a"},
+			},
+		},
+		{
+			name: "least recently used is evicted",
+			size: 2,
+			ttl:  time.Minute,
+			steps: []step{
+				{key: "a", load: true},
+				{key: "b", load: true},
+				{key: "a"},
+				{key: "c", load: true},
+				{key: "a"},
+				{key: "c"},
+				{key: "b", load: true},
+			},
+			evictions: 2,
+		},
+		{
+			name: "expired",
+			size: 2,
+			ttl:  20 * time.Millisecond,
+			steps: []step{
+				{key: "a", load: true},
+				{key: "a"},
+				{key: "a", sleep: 40 * time.Millisecond, load: true},
+				{key: "a"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(tt.size, tt.ttl)
+
+			for i, s := range tt.steps {
+				time.Sleep(s.sleep)
+
+				loaded := false
+				v, err := c.load(context.Background(), s.key, func(ctx context.Context) (interface{}, error) {
+					loaded = true
+					return s.key, nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v != s.key {
+					t.Errorf("step %d: got %v, want %s", i, v, s.key)
+				}
+				if loaded != s.load {
+					t.Errorf("step %d: reading %s loaded = %t, want %t", i, s.key, loaded, s.load)
+				}
+			}
+
+			if stats := c.Stats(); stats.Evictions != tt.evictions || stats.Entries > tt.size {
+				t.Errorf("%d evictions and %d entries, want %d evictions and at most %d entries",
+					stats.Evictions, stats.Entries, tt.evictions, tt.size)
+			}
+		})
+	}
+}
+
+func TestCacheConcurrentMisses(t *testing.T) {
+	const readers = 10
+
+	c := NewCache(10, time.Minute)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	loads := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.load(context.Background(), "a", func(ctx context.Context) (interface{}, error) {
+				mu.Lock()
+				loads++
+				mu.Unlock()
+				<-release
+				return 1, nil
+			})
+			if err != nil || v != 1 {
+				t.Errorf("got %v, %v, want 1", v, err)
+			}
+		}()
+	}
+
+	// Every reader misses before the loader is released, so all of them wait for the same load.
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Misses < readers {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d misses, want %d", c.Stats().Misses, readers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Errorf("the loader ran %d times, want 1", loads)
+	}
+}
+
+// The fake stores count the reads which reach them, that is the cache misses.
+
+type fakeCharacters struct {
+	CharacterStore
+	loads *int
+}
+
+func (s fakeCharacters) GetAll(ctx context.Context, name string, ageFrom int, ageTo int, filters Filters) ([]*Character, Metadata, error) {
+	*s.loads++
+	return []*Character{{ID: 1}}, Metadata{TotalRecords: 1}, nil
+}
+
+func (s fakeCharacters) Get(ctx context.Context, id int) (*Character, error) {
+	*s.loads++
+	return &Character{ID: id}, nil
+}
+
+func (s fakeCharacters) GetByEpisode(ctx context.Context, episodeID int) ([]*Character, error) {
+	*s.loads++
+	return []*Character{{ID: 1}}, nil
+}
+
+func (s fakeCharacters) GetByQuote(ctx context.Context, quoteID int) (*Character, error) {
+	*s.loads++
+	return &Character{ID: 1}, nil
+}
+
+func (s fakeCharacters) Insert(ctx context.Context, character *Character) error { return nil }
+func (s fakeCharacters) Update(ctx context.Context, character *Character) error { return nil }
+func (s fakeCharacters) Delete(ctx context.Context, id int) error               { return nil }
+
+func (s fakeCharacters) LinkEpisode(ctx context.Context, characterID, episodeID int) error {
+	return nil
+}
+
+func (s fakeCharacters) UnlinkEpisode(ctx context.Context, characterID, episodeID int) error {
+	return nil
+}
+
+func (s fakeCharacters) LinkQuote(ctx context.Context, characterID, quoteID int) error {
+	return nil
+}
+
+func (s fakeCharacters) UnlinkQuote(ctx context.Context, characterID, quoteID int) error {
+	return nil
+}
+
+type fakeEpisodes struct {
+	EpisodeStore
+	loads *int
+}
+
+func (s fakeEpisodes) GetAll(ctx context.Context, title string, filters Filters) ([]*Episode, Metadata, error) {
+	*s.loads++
+	return []*Episode{{ID: 1}}, Metadata{TotalRecords: 1}, nil
+}
+
+func (s fakeEpisodes) Get(ctx context.Context, id int) (*Episode, error) {
+	*s.loads++
+	return &Episode{ID: id}, nil
+}
+
+func (s fakeEpisodes) GetByCharacter(ctx context.Context, characterID int) ([]*Episode, error) {
+	*s.loads++
+	return []*Episode{{ID: 1}}, nil
+}
+
+func (s fakeEpisodes) Insert(ctx context.Context, episode *Episode) error { return nil }
+func (s fakeEpisodes) Update(ctx context.Context, episode *Episode) error { return nil }
+func (s fakeEpisodes) Delete(ctx context.Context, id int) error           { return nil }
+
+type fakeQuotes struct {
+	QuoteStore
+	loads *int
+}
+
+func (s fakeQuotes) GetAll(ctx context.Context, quote string, filters Filters) ([]*Quote, Metadata, error) {
+	*s.loads++
+	return []*Quote{{ID: 1}}, Metadata{TotalRecords: 1}, nil
+}
+
+func (s fakeQuotes) Get(ctx context.Context, id int) (*Quote, error) {
+	*s.loads++
+	return &Quote{ID: id}, nil
+}
+
+func (s fakeQuotes) GetQuotesByCharacterID(ctx context.Context, characterID int) ([]*Quote, error) {
+	*s.loads++
+	return []*Quote{{ID: 1}}, nil
+}
+
+func (s fakeQuotes) Insert(ctx context.Context, quote *Quote) error { return nil }
+func (s fakeQuotes) Update(ctx context.Context, quote *Quote) error { return nil }
+func (s fakeQuotes) Delete(ctx context.Context, id int) error       { return nil }
+
+func TestCachedModelsInvalidation(t *testing.T) {
+	ctx := context.Background()
+	filters := Filters{Page: 1, PageSize: 20, Sort: "id"}
+
+	// Character 1 appears in episode 2 and says quote 3.
+	var (
+		getCharacter   = func(m Models) error { _, err := m.Characters.Get(ctx, 1); return err }
+		listCharacters = func(m Models) error { _, _, err := m.Characters.GetAll(ctx, "", 0, 0, filters); return err }
+		episodeCast    = func(m Models) error { _, err := m.Characters.GetByEpisode(ctx, 2); return err }
+		quoteSpeaker   = func(m Models) error { _, err := m.Characters.GetByQuote(ctx, 3); return err }
+		getEpisode     = func(m Models) error { _, err := m.Episodes.Get(ctx, 2); return err }
+		listEpisodes   = func(m Models) error { _, _, err := m.Episodes.GetAll(ctx, "", filters); return err }
+		appearances    = func(m Models) error { _, err := m.Episodes.GetByCharacter(ctx, 1); return err }
+		getQuote       = func(m Models) error { _, err := m.Quotes.Get(ctx, 3); return err }
+		listQuotes     = func(m Models) error { _, _, err := m.Quotes.GetAll(ctx, "", filters); return err }
+		lines          = func(m Models) error { _, err := m.Quotes.GetQuotesByCharacterID(ctx, 1); return err }
+	)
+
+	tests := []struct {
+		name  string
+		read  func(m Models) error
+		write func(m Models) error
+	}{
+		{"character update, character", getCharacter, func(m Models) error { return m.Characters.Update(ctx, &Character{ID: 1}) }},
+		{"character update, episode cast", episodeCast, func(m Models) error { return m.Characters.Update(ctx, &Character{ID: 1}) }},
+		{"character update, quote speaker", quoteSpeaker, func(m Models) error { return m.Characters.Update(ctx, &Character{ID: 1}) }},
+		{"character insert, list", listCharacters, func(m Models) error { return m.Characters.Insert(ctx, &Character{}) }},
+		{"character delete, character", getCharacter, func(m Models) error { return m.Characters.Delete(ctx, 1) }},
+		{"character delete, appearances", appearances, func(m Models) error { return m.Characters.Delete(ctx, 1) }},
+		{"character delete, lines", lines, func(m Models) error { return m.Characters.Delete(ctx, 1) }},
+		{"link episode, cast", episodeCast, func(m Models) error { return m.Characters.LinkEpisode(ctx, 1, 2) }},
+		{"link episode, appearances", appearances, func(m Models) error { return m.Characters.LinkEpisode(ctx, 1, 2) }},
+		{"unlink episode, cast", episodeCast, func(m Models) error { return m.Characters.UnlinkEpisode(ctx, 1, 2) }},
+		{"unlink episode, appearances", appearances, func(m Models) error { return m.Characters.UnlinkEpisode(ctx, 1, 2) }},
+		{"link quote, lines", lines, func(m Models) error { return m.Characters.LinkQuote(ctx, 1, 3) }},
+		{"link quote, speaker", quoteSpeaker, func(m Models) error { return m.Characters.LinkQuote(ctx, 1, 3) }},
+		{"unlink quote, lines", lines, func(m Models) error { return m.Characters.UnlinkQuote(ctx, 1, 3) }},
+		{"unlink quote, speaker", quoteSpeaker, func(m Models) error { return m.Characters.UnlinkQuote(ctx, 1, 3) }},
+		{"episode update, episode", getEpisode, func(m Models) error { return m.Episodes.Update(ctx, &Episode{ID: 2}) }},
+		{"episode update, list", listEpisodes, func(m Models) error { return m.Episodes.Update(ctx, &Episode{ID: 2}) }},
+		{"episode update, appearances", appearances, func(m Models) error { return m.Episodes.Update(ctx, &Episode{ID: 2}) }},
+		{"episode insert, neighbour", getEpisode, func(m Models) error { return m.Episodes.Insert(ctx, &Episode{}) }},
+		{"episode delete, cast", episodeCast, func(m Models) error { return m.Episodes.Delete(ctx, 2) }},
+		{"quote update, quote", getQuote, func(m Models) error { return m.Quotes.Update(ctx, &Quote{ID: 3}) }},
+		{"quote update, lines", lines, func(m Models) error { return m.Quotes.Update(ctx, &Quote{ID: 3}) }},
+		{"quote insert, list", listQuotes, func(m Models) error { return m.Quotes.Insert(ctx, &Quote{}) }},
+		{"quote delete, quote", getQuote, func(m Models) error { return m.Quotes.Delete(ctx, 3) }},
+		{"quote delete, speaker", quoteSpeaker, func(m Models) error { return m.Quotes.Delete(ctx, 3) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loads := 0
+			m := Models{
+				Characters: fakeCharacters{loads: &loads},
+				Episodes:   fakeEpisodes{loads: &loads},
+				Quotes:     fakeQuotes{loads: &loads},
+			}
+			m.EnableCache(NewCache(100, time.Minute))
+
+			for i := 0; i < 2; i++ {
+				if err := tt.read(m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if loads != 1 {
+				t.Fatalf("%d loads before the write, want 1", loads)
+			}
+
+			if err := tt.write(m); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.read(m); err != nil {
+				t.Fatal(err)
+			}
+			if loads != 2 {
+				t.Errorf("%d loads after the write, want 2", loads)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package model
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -11,23 +12,24 @@ import (
 )
 
 type Character struct {
-	ID        int    `json:"id"`
-	Name      string `json:"name"`
-	Age       int    `json:"age"`
-	Gender    string `json:"gender"`
-	Status    string `json:"status"`
-	Nation    string `json:"nation"`
-	CreatedAt string `json:"createdAt"`
-	UpdatedAt string `json:"updatedAt"`
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Age       int       `json:"age"`
+	Gender    string    `json:"gender"`
+	Status    string    `json:"status"`
+	Nation    string    `json:"nation"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
 }
 
 type CharacterModel struct {
-	DB       *sql.DB
+	DB       DBTX
 	InfoLog  *log.Logger
 	ErrorLog *log.Logger
+	Timeouts Timeouts
 }
 
-func (m CharacterModel) GetAll(name string, age_from int, age_to int, filters Filters) ([]*Character, Metadata, error) {
+func (m CharacterModel) GetAll(ctx context.Context, name string, age_from int, age_to int, filters Filters) ([]*Character, Metadata, error) {
 
 	query := fmt.Sprintf(
 		`
@@ -40,7 +42,7 @@ func (m CharacterModel) GetAll(name string, age_from int, age_to int, filters Fi
 		LIMIT $4 OFFSET $5
 		`,
 		filters.sortColumn(), filters.sortDirection())
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
 	defer cancel()
 
 	args := []interface{}{name, age_from, age_to, filters.limit(), filters.offset()}
@@ -51,7 +53,7 @@ func (m CharacterModel) GetAll(name string, age_from int, age_to int, filters Fi
 	}
 	defer func() {
 		if err := rows.Close(); err != nil {
-			m.ErrorLog.Println(err)
+			logError(m.ErrorLog, ctx, err)
 		}
 	}()
 
@@ -84,20 +86,20 @@ func (m CharacterModel) GetAll(name string, age_from int, age_to int, filters Fi
 	return characters, metadata, nil
 }
 
-func (m CharacterModel) Insert(character *Character) error {
+func (m CharacterModel) Insert(ctx context.Context, character *Character) error {
 	query := `
 		INSERT INTO characters (name, age, gender, status, nation) 
 		VALUES ($1, $2, $3, $4, $5) 
 		RETURNING id, created_at, updated_at
 		`
 	args := []interface{}{character.Name, character.Age, character.Gender, character.Status, character.Nation}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&character.ID, &character.CreatedAt, &character.UpdatedAt)
 }
 
-func (m CharacterModel) Get(id int) (*Character, error) {
+func (m CharacterModel) Get(ctx context.Context, id int) (*Character, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
@@ -107,7 +109,7 @@ func (m CharacterModel) Get(id int) (*Character, error) {
 		WHERE id = $1
 		`
 	var character Character
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
 	defer cancel()
 
 	row := m.DB.QueryRowContext(ctx, query, id)
@@ -118,7 +120,7 @@ func (m CharacterModel) Get(id int) (*Character, error) {
 	return &character, nil
 }
 
-func (m CharacterModel) Update(character *Character) error {
+func (m CharacterModel) Update(ctx context.Context, character *Character) error {
 	query := `
 		UPDATE characters
 		SET name = $1, age = $2, gender = $3, status = $4, nation = $5, updated_at = CURRENT_TIMESTAMP
@@ -126,13 +128,13 @@ func (m CharacterModel) Update(character *Character) error {
 		RETURNING updated_at
 		`
 	args := []interface{}{character.Name, character.Age, character.Gender, character.Status, character.Nation, character.ID, character.UpdatedAt}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&character.UpdatedAt)
 }
 
-func (m CharacterModel) Delete(id int) error {
+func (m CharacterModel) Delete(ctx context.Context, id int) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -140,14 +142,14 @@ func (m CharacterModel) Delete(id int) error {
 		DELETE FROM characters
 		WHERE id = $1
 		`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, id)
 	return err
 }
 
-func (m *CharacterModel) GetByEpisode(episodeID int) ([]*Character, error) {
+func (m *CharacterModel) GetByEpisode(ctx context.Context, episodeID int) ([]*Character, error) {
 	query := `
         SELECT c.id, c.name, c.age, c.gender, c.status, c.nation, c.created_at, c.updated_at
         FROM characters c
@@ -156,7 +158,10 @@ func (m *CharacterModel) GetByEpisode(episodeID int) ([]*Character, error) {
         ORDER BY c.id
     `
 
-	rows, err := m.DB.Query(query, episodeID)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, episodeID)
 	if err != nil {
 		return nil, err
 	}
@@ -172,10 +177,14 @@ func (m *CharacterModel) GetByEpisode(episodeID int) ([]*Character, error) {
 		characters = append(characters, &character)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
 	return characters, nil
 }
 
-func (m *CharacterModel) GetByQuote(quoteID int) (*Character, error) {
+func (m *CharacterModel) GetByQuote(ctx context.Context, quoteID int) (*Character, error) {
 	query := `
         SELECT c.id, c.name, c.age, c.gender, c.status, c.nation, c.created_at, c.updated_at
         FROM characters c
@@ -185,7 +194,7 @@ func (m *CharacterModel) GetByQuote(quoteID int) (*Character, error) {
     `
 
 	var character Character
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
 	defer cancel()
 
 	row := m.DB.QueryRowContext(ctx, query, quoteID)
@@ -196,6 +205,89 @@ func (m *CharacterModel) GetByQuote(quoteID int) (*Character, error) {
 	return &character, nil
 }
 
+// LinkEpisode records that a character appears in an episode. Linking them twice is a no-op.
+func (m *CharacterModel) LinkEpisode(ctx context.Context, characterID, episodeID int) error {
+	query := `
+		INSERT INTO characters_and_episodes (character_id, episode_id)
+		SELECT $1, $2
+		WHERE NOT EXISTS (
+			SELECT 1 FROM characters_and_episodes WHERE character_id = $1 AND episode_id = $2
+		)`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, characterID, episodeID)
+	return err
+}
+
+// UnlinkEpisode removes a character from an episode.
+func (m *CharacterModel) UnlinkEpisode(ctx context.Context, characterID, episodeID int) error {
+	query := `
+		DELETE FROM characters_and_episodes
+		WHERE character_id = $1 AND episode_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, characterID, episodeID)
+	return err
+}
+
+// LinkQuote records that a quote was said by a character. Linking them twice is a no-op.
+func (m *CharacterModel) LinkQuote(ctx context.Context, characterID, quoteID int) error {
+	query := `
+		INSERT INTO characters_and_quotes (character_id, quote_id)
+		SELECT $1, $2
+		WHERE NOT EXISTS (
+			SELECT 1 FROM characters_and_quotes WHERE character_id = $1 AND quote_id = $2
+		)`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, characterID, quoteID)
+	return err
+}
+
+// UnlinkQuote removes the link between a character and a quote.
+func (m *CharacterModel) UnlinkQuote(ctx context.Context, characterID, quoteID int) error {
+	query := `
+		DELETE FROM characters_and_quotes
+		WHERE character_id = $1 AND quote_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, characterID, quoteID)
+	return err
+}
+
+// GetByName returns the character with the given name, ignoring case. Names are the natural key
+// of characters when seeding, but nothing enforces their uniqueness, so the oldest one wins.
+func (m CharacterModel) GetByName(ctx context.Context, name string) (*Character, error) {
+	query := `
+		SELECT id, name, age, gender, status, nation, created_at, updated_at
+		FROM characters
+		WHERE LOWER(name) = LOWER($1)
+		ORDER BY id
+		LIMIT 1`
+
+	var character Character
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, query, name)
+	err := row.Scan(&character.ID, &character.Name, &character.Age, &character.Gender, &character.Status, &character.Nation, &character.CreatedAt, &character.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return &character, nil
+}
+
 func ValidateCharacter(v *validator.Validator, character *Character) {
 	v.Check(character.Name != "", "name", "must be provided")
 	v.Check(character.Age <= 10000, "age", "must not be more than 10000 bytes long")
@@ -204,3 +296,8 @@ func ValidateCharacter(v *validator.Validator, character *Character) {
 	v.Check(character.Nation != "", "nation", "must be provided")
 
 }
+
+// Stamp returns the ID and update time of a character, which identify a version of it.
+func (c *Character) Stamp() (int, time.Time) {
+	return c.ID, c.UpdatedAt
+}
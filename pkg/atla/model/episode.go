@@ -3,6 +3,7 @@ package model
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -11,33 +12,48 @@ import (
 )
 
 type Episode struct {
-	ID        int    `json:"id"`
-	Title     string `json:"title"`
-	Air_Date  string `json:"air_date"`
-	CreatedAt string `json:"createdAt"`
-	UpdatedAt string `json:"updatedAt"`
+	ID        int       `json:"id"`
+	Title     string    `json:"title"`
+	Air_Date  string    `json:"air_date"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// PrevID and NextID are the IDs of the episodes aired right before and after this one, or
+	// nil if there is none. They are only filled in by the read queries.
+	PrevID *int `json:"-"`
+	NextID *int `json:"-"`
 }
 
+// episodesWithNeighbours selects every episode along with the IDs of its neighbours in airing
+// order. The window has to be computed before any filtering, so the read queries select from it
+// as a subquery.
+const episodesWithNeighbours = `
+	SELECT *,
+		LAG(id) OVER (ORDER BY air_date, id) AS prev_id,
+		LEAD(id) OVER (ORDER BY air_date, id) AS next_id
+	FROM episodes`
+
 type EpisodeModel struct {
-	DB       *sql.DB
+	DB       DBTX
 	InfoLog  *log.Logger
 	ErrorLog *log.Logger
+	Timeouts Timeouts
 }
 
-func (m EpisodeModel) GetAll(title string, filters Filters) ([]*Episode, Metadata, error) {
+func (m EpisodeModel) GetAll(ctx context.Context, title string, filters Filters) ([]*Episode, Metadata, error) {
 	// Retrieve all episodes from the database.
 	query := fmt.Sprintf(
 		`
-		SELECT count(*) OVER(), id, title, air_date, created_at, updated_at
-		FROM episodes
+		SELECT count(*) OVER(), id, title, air_date, created_at, updated_at, prev_id, next_id
+		FROM (%s) episodes
 		WHERE (title ILIKE '%%' || $1 || '%%' OR $1 = '')
 		ORDER BY %s %s, id ASC
 		LIMIT $2 OFFSET $3
 		`,
-		filters.sortColumn(), filters.sortDirection())
+		episodesWithNeighbours, filters.sortColumn(), filters.sortDirection())
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Bound the query with the list timeout, -db-list-timeout.
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
 	defer cancel()
 
 	// Organize our placeholder parameter values in a slice.
@@ -54,7 +70,7 @@ func (m EpisodeModel) GetAll(title string, filters Filters) ([]*Episode, Metadat
 	// before GetAll returns.
 	defer func() {
 		if err := rows.Close(); err != nil {
-			m.ErrorLog.Println(err)
+			logError(m.ErrorLog, ctx, err)
 		}
 	}()
 
@@ -68,7 +84,9 @@ func (m EpisodeModel) GetAll(title string, filters Filters) ([]*Episode, Metadat
 			&episode.Title,
 			&episode.Air_Date,
 			&episode.CreatedAt,
-			&episode.UpdatedAt)
+			&episode.UpdatedAt,
+			&episode.PrevID,
+			&episode.NextID)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -91,41 +109,41 @@ func (m EpisodeModel) GetAll(title string, filters Filters) ([]*Episode, Metadat
 	return episodes, metadata, nil
 }
 
-func (m EpisodeModel) Insert(episode *Episode) error {
+func (m EpisodeModel) Insert(ctx context.Context, episode *Episode) error {
 	query := `
 		INSERT INTO episodes (title, air_date) 
 		VALUES ($1, $2) 
 		RETURNING id, created_at, updated_at
 		`
 	args := []interface{}{episode.Title, episode.Air_Date}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&episode.ID, &episode.CreatedAt, &episode.UpdatedAt)
 }
 
-func (m EpisodeModel) Get(id int) (*Episode, error) {
+func (m EpisodeModel) Get(ctx context.Context, id int) (*Episode, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 	query := `
-		SELECT id, title, air_date, created_at, updated_at 
-		FROM episodes
+		SELECT id, title, air_date, created_at, updated_at, prev_id, next_id
+		FROM (` + episodesWithNeighbours + `) episodes
 		WHERE id = $1
 		`
 	var episode Episode
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
 	defer cancel()
 
 	row := m.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(&episode.ID, &episode.Title, &episode.Air_Date, &episode.CreatedAt, &episode.UpdatedAt)
+	err := row.Scan(&episode.ID, &episode.Title, &episode.Air_Date, &episode.CreatedAt, &episode.UpdatedAt, &episode.PrevID, &episode.NextID)
 	if err != nil {
 		return nil, fmt.Errorf("cannot retrive episode with id: %v, %w", id, err)
 	}
 	return &episode, nil
 }
 
-func (m EpisodeModel) Update(episode *Episode) error {
+func (m EpisodeModel) Update(ctx context.Context, episode *Episode) error {
 	query := `
 		UPDATE episodes
 		SET title = $1, air_date = $2, updated_at = CURRENT_TIMESTAMP
@@ -133,13 +151,13 @@ func (m EpisodeModel) Update(episode *Episode) error {
 		RETURNING updated_at
 		`
 	args := []interface{}{episode.Title, episode.Air_Date, episode.ID, episode.UpdatedAt}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&episode.UpdatedAt)
 }
 
-func (m EpisodeModel) Delete(id int) error {
+func (m EpisodeModel) Delete(ctx context.Context, id int) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -147,29 +165,56 @@ func (m EpisodeModel) Delete(id int) error {
 		DELETE FROM episodes
 		WHERE id = $1
 		`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, id)
 	return err
 }
 
+// GetByTitle returns the episode with the given title, the oldest one if there are several.
+func (m EpisodeModel) GetByTitle(ctx context.Context, title string) (*Episode, error) {
+	query := `
+		SELECT id, title, air_date, created_at, updated_at, prev_id, next_id
+		FROM (` + episodesWithNeighbours + `) episodes
+		WHERE title = $1
+		ORDER BY id
+		LIMIT 1`
+
+	var episode Episode
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, query, title)
+	err := row.Scan(&episode.ID, &episode.Title, &episode.Air_Date, &episode.CreatedAt, &episode.UpdatedAt, &episode.PrevID, &episode.NextID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return &episode, nil
+}
+
 func ValidateEpisode(v *validator.Validator, episode *Episode) {
 	v.Check(episode.Title != "", "title", "must be provided")
 	v.Check(episode.Air_Date != "", "title", "must be provided")
 
 }
 
-func (m *EpisodeModel) GetByCharacter(characterID int) ([]*Episode, error) {
+func (m *EpisodeModel) GetByCharacter(ctx context.Context, characterID int) ([]*Episode, error) {
 	query := `
-        SELECT e.id, e.title, e.air_date, e.created_at, e.updated_at
-        FROM episodes e
+        SELECT e.id, e.title, e.air_date, e.created_at, e.updated_at, e.prev_id, e.next_id
+        FROM (` + episodesWithNeighbours + `) e
         JOIN characters_and_episodes ce ON e.id = ce.episode_id
         WHERE ce.character_id = $1
         ORDER BY e.id
     `
 
-	rows, err := m.DB.Query(query, characterID)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, characterID)
 	if err != nil {
 		return nil, err
 	}
@@ -178,12 +223,21 @@ func (m *EpisodeModel) GetByCharacter(characterID int) ([]*Episode, error) {
 	var episodes []*Episode
 	for rows.Next() {
 		var episode Episode
-		err := rows.Scan(&episode.ID, &episode.Title, &episode.Air_Date, &episode.CreatedAt, &episode.UpdatedAt)
+		err := rows.Scan(&episode.ID, &episode.Title, &episode.Air_Date, &episode.CreatedAt, &episode.UpdatedAt, &episode.PrevID, &episode.NextID)
 		if err != nil {
 			return nil, err
 		}
 		episodes = append(episodes, &episode)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
 	return episodes, nil
 }
+
+// Stamp returns the ID and update time of an episode, which identify a version of it.
+func (e *Episode) Stamp() (int, time.Time) {
+	return e.ID, e.UpdatedAt
+}
@@ -0,0 +1,295 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The states of a job. A job is pending until a worker claims it, running while the worker has
+// it, and then either succeeded, pending again to be retried later, or dead once it has failed
+// for the last time.
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobDead      = "dead"
+)
+
+// JobStatuses are the valid job states.
+var JobStatuses = []string{JobPending, JobRunning, JobSucceeded, JobDead}
+
+// ErrJobNotRetryable is returned by Retry for a job which is running or has succeeded.
+var ErrJobNotRetryable = errors.New("job can't be retried")
+
+// Job is a unit of background work in the jobs table. Payload holds the arguments of the
+// handler registered for Kind, as JSON.
+type Job struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LockedUntil *time.Time      `json:"locked_until"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// JobModel wraps the jobs table, which the job queue is stored in.
+type JobModel struct {
+	DB       DBTX
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+	Timeouts Timeouts
+}
+
+// jobColumns are the columns read by scanJob, in order.
+const jobColumns = `id, kind, payload, status, attempts, max_attempts, run_at, locked_until, last_error, created_at, updated_at`
+
+func scanJob(row interface{ Scan(...interface{}) error }, job *Job, extra ...interface{}) error {
+	dest := append(extra,
+		&job.ID,
+		&job.Kind,
+		(*[]byte)(&job.Payload),
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LockedUntil,
+		&job.LastError,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	)
+	return row.Scan(dest...)
+}
+
+// Insert adds a pending job, which becomes runnable at job.RunAt, or straight away if it is zero.
+func (m JobModel) Insert(ctx context.Context, job *Job) error {
+	query := `
+		INSERT INTO jobs (kind, payload, max_attempts, run_at)
+		VALUES ($1, $2::jsonb, $3, COALESCE($4, NOW()))
+		RETURNING ` + jobColumns
+
+	var runAt *time.Time
+	if !job.RunAt.IsZero() {
+		runAt = &job.RunAt
+	}
+	payload := string(job.Payload)
+	if payload == "" {
+		payload = "{}"
+	}
+
+	args := []interface{}{job.Kind, payload, job.MaxAttempts, runAt}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	return scanJob(m.DB.QueryRowContext(ctx, query, args...), job)
+}
+
+// Claim locks the next runnable job of one of the kinds in leases, marks it running and returns
+// it. leases gives, by kind, how long the job is locked for: if the worker hasn't finished it by
+// then, for example because its process died, another worker may claim it again. Concurrent
+// workers skip the rows locked by each other, so each job is claimed by a single worker. Claim
+// returns ErrRecordNotFound when no job is runnable.
+func (m JobModel) Claim(ctx context.Context, leases map[string]time.Duration) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = 'running',
+			attempts = attempts + 1,
+			locked_until = NOW() + make_interval(secs => ($2::jsonb ->> kind)::float8),
+			updated_at = NOW()
+		WHERE id = (
+			SELECT id
+			FROM jobs
+			WHERE kind = ANY($1)
+				AND ((status = 'pending' AND run_at <= NOW()) OR (status = 'running' AND locked_until < NOW()))
+			ORDER BY run_at, id
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING ` + jobColumns
+
+	kinds := make([]string, 0, len(leases))
+	seconds := make(map[string]float64, len(leases))
+	for kind, lease := range leases {
+		kinds = append(kinds, kind)
+		seconds[kind] = lease.Seconds()
+	}
+	js, err := json.Marshal(seconds)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	var job Job
+	err = scanJob(m.DB.QueryRowContext(ctx, query, pq.Array(kinds), string(js)), &job)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &job, nil
+}
+
+// Complete marks a claimed job as succeeded. It returns ErrEditConflict if the job is no longer
+// held by the attempt that claimed it, because its lease expired and another worker claimed it.
+func (m JobModel) Complete(ctx context.Context, job *Job) error {
+	query := `
+		UPDATE jobs
+		SET status = 'succeeded', locked_until = NULL, last_error = '', updated_at = NOW()
+		WHERE id = $1 AND attempts = $2 AND status = 'running'
+		RETURNING ` + jobColumns
+
+	return m.finish(ctx, job, query, job.ID, job.Attempts)
+}
+
+// Fail records the failure of a claimed job. The job is retried at retryAt, or dead if retryAt
+// is nil. Like Complete, it returns ErrEditConflict if the job is no longer held by the attempt.
+func (m JobModel) Fail(ctx context.Context, job *Job, message string, retryAt *time.Time) error {
+	query := `
+		UPDATE jobs
+		SET status = CASE WHEN $4::timestamptz IS NULL THEN 'dead' ELSE 'pending' END,
+			run_at = COALESCE($4, run_at),
+			locked_until = NULL,
+			last_error = $3,
+			updated_at = NOW()
+		WHERE id = $1 AND attempts = $2 AND status = 'running'
+		RETURNING ` + jobColumns
+
+	return m.finish(ctx, job, query, job.ID, job.Attempts, message, retryAt)
+}
+
+func (m JobModel) finish(ctx context.Context, job *Job, query string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	err := scanJob(m.DB.QueryRowContext(ctx, query, args...), job)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get returns the job with the given ID.
+func (m JobModel) Get(ctx context.Context, id int64) (*Job, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT ` + jobColumns + `
+		FROM jobs
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	var job Job
+	err := scanJob(m.DB.QueryRowContext(ctx, query, id), &job)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &job, nil
+}
+
+// GetAll returns a page of the jobs with the given status and kind, or of any status or kind
+// when they are empty.
+func (m JobModel) GetAll(ctx context.Context, status string, kind string, filters Filters) ([]*Job, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), `+jobColumns+`
+		FROM jobs
+		WHERE (status = $1 OR $1 = '')
+			AND (kind = $2 OR $2 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`,
+		filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	args := []interface{}{status, kind, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			logError(m.ErrorLog, ctx, err)
+		}
+	}()
+
+	totalRecords := 0
+	jobs := []*Job{}
+
+	for rows.Next() {
+		var job Job
+		if err := scanJob(rows, &job, &totalRecords); err != nil {
+			return nil, Metadata{}, err
+		}
+		jobs = append(jobs, &job)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return jobs, metadata, nil
+}
+
+// Retry makes a dead job, or a pending one waiting for its next attempt, runnable straight away
+// with all of its attempts available again. It returns ErrJobNotRetryable for a job which is
+// running or has succeeded.
+func (m JobModel) Retry(ctx context.Context, id int64) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = 'pending', attempts = 0, run_at = NOW(), locked_until = NULL, updated_at = NOW()
+		WHERE id = $1 AND status IN ('pending', 'dead')
+		RETURNING ` + jobColumns
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	var job Job
+	err := scanJob(m.DB.QueryRowContext(ctx, query, id), &job)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Tell a job which can't be retried apart from one which doesn't exist.
+		if _, err := m.Get(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrJobNotRetryable
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
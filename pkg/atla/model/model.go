@@ -1,10 +1,13 @@
 package model
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"time"
 )
 
 var (
@@ -15,48 +18,177 @@ var (
 	ErrEditConflict = errors.New("edit conflict")
 )
 
+// CharacterStore is implemented by CharacterModel, and by CachedCharacterModel which caches
+// its reads.
+type CharacterStore interface {
+	GetAll(ctx context.Context, name string, ageFrom int, ageTo int, filters Filters) ([]*Character, Metadata, error)
+	Insert(ctx context.Context, character *Character) error
+	Get(ctx context.Context, id int) (*Character, error)
+	GetByName(ctx context.Context, name string) (*Character, error)
+	Update(ctx context.Context, character *Character) error
+	Delete(ctx context.Context, id int) error
+	GetByEpisode(ctx context.Context, episodeID int) ([]*Character, error)
+	GetByQuote(ctx context.Context, quoteID int) (*Character, error)
+	LinkEpisode(ctx context.Context, characterID, episodeID int) error
+	UnlinkEpisode(ctx context.Context, characterID, episodeID int) error
+	LinkQuote(ctx context.Context, characterID, quoteID int) error
+	UnlinkQuote(ctx context.Context, characterID, quoteID int) error
+}
+
+// EpisodeStore is implemented by EpisodeModel, and by CachedEpisodeModel which caches its reads.
+type EpisodeStore interface {
+	GetAll(ctx context.Context, title string, filters Filters) ([]*Episode, Metadata, error)
+	Insert(ctx context.Context, episode *Episode) error
+	Get(ctx context.Context, id int) (*Episode, error)
+	GetByTitle(ctx context.Context, title string) (*Episode, error)
+	Update(ctx context.Context, episode *Episode) error
+	Delete(ctx context.Context, id int) error
+	GetByCharacter(ctx context.Context, characterID int) ([]*Episode, error)
+}
+
+// QuoteStore is implemented by QuoteModel, and by CachedQuoteModel which caches its reads.
+type QuoteStore interface {
+	GetAll(ctx context.Context, quote string, filters Filters) ([]*Quote, Metadata, error)
+	Insert(ctx context.Context, quote *Quote) error
+	Get(ctx context.Context, id int) (*Quote, error)
+	GetByText(ctx context.Context, text string) (*Quote, error)
+	Update(ctx context.Context, quote *Quote) error
+	Delete(ctx context.Context, id int) error
+	GetQuotesByCharacterID(ctx context.Context, characterID int) ([]*Quote, error)
+}
+
 type Models struct {
-	Characters  CharacterModel
-	Episodes    EpisodeModel
-	Quotes      QuoteModel
+	Characters  CharacterStore
+	Episodes    EpisodeStore
+	Quotes      QuoteStore
 	Users       UserModel
 	Tokens      TokenModel
 	Permissions PermissionModel
+	Jobs        JobModel
+}
+
+// DBTX is implemented by *sql.DB and *sql.Tx, so that the models can also run their queries in
+// a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
-func NewModels(db *sql.DB) Models {
+// Timeouts bound how long each kind of database operation may take. A model method's context
+// can shorten them, for example when the client of the request goes away, but not extend them.
+type Timeouts struct {
+	Read  time.Duration // reading a single record
+	List  time.Duration // reading a list, which may have to scan and sort many rows
+	Write time.Duration // inserts, updates and deletes
+}
+
+// DefaultTimeouts are used by the -db-*-timeout flags.
+var DefaultTimeouts = Timeouts{
+	Read:  3 * time.Second,
+	List:  7 * time.Second,
+	Write: 3 * time.Second,
+}
+
+// NewModels returns the models of db, which is either the connection pool or a transaction.
+func NewModels(db DBTX, timeouts Timeouts) Models {
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 	return Models{
-		Characters: CharacterModel{
+		Characters: &CharacterModel{
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
+			Timeouts: timeouts,
 		},
-		Episodes: EpisodeModel{
+		Episodes: &EpisodeModel{
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
+			Timeouts: timeouts,
 		},
-		Quotes: QuoteModel{
+		Quotes: &QuoteModel{
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
+			Timeouts: timeouts,
 		},
 		Users: UserModel{
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
+			Timeouts: timeouts,
 		},
 		Tokens: TokenModel{
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
+			Timeouts: timeouts,
 		},
 		Permissions: PermissionModel{
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
+			Timeouts: timeouts,
+		},
+		Jobs: JobModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+			Timeouts: timeouts,
 		},
 	}
 }
+
+type contextKey string
+
+// requestIDContextKey is used as a key for the ID of the HTTP request an operation is run for.
+const requestIDContextKey = contextKey("requestID")
+
+// ContextWithRequestID returns a copy of ctx carrying the request ID, so that the log entries
+// written by the models can be matched with the request that caused them.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, id)
+}
+
+// RequestIDFromContext returns the request ID stored in ctx, or "" if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// logError writes err to logger, prefixed with the request ID from ctx if there is one.
+func logError(logger *log.Logger, ctx context.Context, err error) {
+	message := err.Error()
+	if id := RequestIDFromContext(ctx); id != "" {
+		message = fmt.Sprintf("request_id=%s %s", id, message)
+	}
+
+	// Report the caller of logError rather than this line with log.Lshortfile.
+	logger.Output(2, message)
+}
+
+// SchemaVersion returns the current migration version of the database, and whether the last
+// migration failed before completing. It returns ErrRecordNotFound if no migration has been
+// applied yet.
+func SchemaVersion(ctx context.Context, db *sql.DB) (int, bool, error) {
+	query := `
+		SELECT version, dirty
+		FROM schema_migrations
+		LIMIT 1`
+
+	var version int
+	var dirty bool
+
+	err := db.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, ErrRecordNotFound
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
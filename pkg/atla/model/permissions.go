@@ -2,9 +2,7 @@ package model
 
 import (
 	"context"
-	"database/sql"
 	"log"
-	"time"
 
 	"github.com/lib/pq"
 )
@@ -24,13 +22,14 @@ func (p Permissions) Include(code string) bool {
 }
 
 type PermissionModel struct {
-	DB       *sql.DB
+	DB       DBTX
 	InfoLog  *log.Logger
 	ErrorLog *log.Logger
+	Timeouts Timeouts
 }
 
 // GetAllForUser returns all permission codes for a specific user in a Permissions slice.
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 	query := `
 		SELECT permissions.code
 		FROM permissions
@@ -39,7 +38,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		WHERE users.id = $1
 		`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -48,7 +47,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	}
 	defer func() {
 		if err := rows.Close(); err != nil {
-			m.ErrorLog.Println(err)
+			logError(m.ErrorLog, ctx, err)
 		}
 	}()
 
@@ -72,14 +71,74 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-// AddForUser adds the provided codes for a specific user.
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+// GetAll returns the codes of all permissions.
+func (m PermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	query := `
+		SELECT code
+		FROM permissions
+		ORDER BY code
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			logError(m.ErrorLog, ctx, err)
+		}
+	}()
+
+	var permissions Permissions
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// AddForUser adds the provided codes for a specific user. Codes the user already has are left
+// alone.
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	query := `
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+// RemoveForUser removes the provided codes from a specific user.
+func (m PermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	query := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+			AND users_permissions.user_id = $1
+			AND permissions.code = ANY($2)
 		`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
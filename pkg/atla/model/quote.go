@@ -3,6 +3,7 @@ package model
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -18,12 +19,13 @@ type Quote struct {
 }
 
 type QuoteModel struct {
-	DB       *sql.DB
+	DB       DBTX
 	InfoLog  *log.Logger
 	ErrorLog *log.Logger
+	Timeouts Timeouts
 }
 
-func (m QuoteModel) GetAll(quote string, filters Filters) ([]*Quote, Metadata, error) {
+func (m QuoteModel) GetAll(ctx context.Context, quote string, filters Filters) ([]*Quote, Metadata, error) {
 	query := fmt.Sprintf(
 		`
 		SELECT count(*) OVER(), id, quote, created_at, updated_at
@@ -34,8 +36,8 @@ func (m QuoteModel) GetAll(quote string, filters Filters) ([]*Quote, Metadata, e
 		`,
 		filters.sortColumn(), filters.sortDirection())
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 7*time.Second)
+	// Bound the query with the list timeout, -db-list-timeout.
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
 	defer cancel()
 
 	// Organize our placeholder parameter values in a slice.
@@ -52,7 +54,7 @@ func (m QuoteModel) GetAll(quote string, filters Filters) ([]*Quote, Metadata, e
 	// before GetAll returns.
 	defer func() {
 		if err := rows.Close(); err != nil {
-			m.ErrorLog.Println(err)
+			logError(m.ErrorLog, ctx, err)
 		}
 	}()
 
@@ -85,20 +87,20 @@ func (m QuoteModel) GetAll(quote string, filters Filters) ([]*Quote, Metadata, e
 	return quotes, metadata, nil
 }
 
-func (m QuoteModel) Insert(quote *Quote) error {
+func (m QuoteModel) Insert(ctx context.Context, quote *Quote) error {
 	query := `
 		INSERT INTO quotes (quote) 
 		VALUES ($1) 
 		RETURNING id, created_at, updated_at
 		`
 	args := []interface{}{quote.Quote}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&quote.ID, &quote.CreatedAt, &quote.UpdatedAt)
 }
 
-func (m QuoteModel) Get(id int) (*Quote, error) {
+func (m QuoteModel) Get(ctx context.Context, id int) (*Quote, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
@@ -108,7 +110,7 @@ func (m QuoteModel) Get(id int) (*Quote, error) {
 		WHERE id = $1
 		`
 	var quote Quote
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
 	defer cancel()
 
 	row := m.DB.QueryRowContext(ctx, query, id)
@@ -123,7 +125,7 @@ func (m QuoteModel) Get(id int) (*Quote, error) {
 	return &quote, nil
 }
 
-func (m QuoteModel) Update(quote *Quote) error {
+func (m QuoteModel) Update(ctx context.Context, quote *Quote) error {
 	query := `
 		UPDATE quotes
 		SET quote = $1, updated_at = CURRENT_TIMESTAMP
@@ -131,13 +133,13 @@ func (m QuoteModel) Update(quote *Quote) error {
 		RETURNING updated_at
 		`
 	args := []interface{}{quote.Quote, quote.ID}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&quote.UpdatedAt)
 }
 
-func (m QuoteModel) Delete(id int) error {
+func (m QuoteModel) Delete(ctx context.Context, id int) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -145,18 +147,41 @@ func (m QuoteModel) Delete(id int) error {
 		DELETE FROM quotes
 		WHERE id = $1
 		`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, id)
 	return err
 }
 
+// GetByText returns the quote with exactly the given text, the oldest one if there are several.
+func (m QuoteModel) GetByText(ctx context.Context, text string) (*Quote, error) {
+	query := `
+		SELECT id, quote, created_at, updated_at
+		FROM quotes
+		WHERE quote = $1
+		ORDER BY id
+		LIMIT 1`
+
+	var quote Quote
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, text).Scan(&quote.ID, &quote.Quote, &quote.CreatedAt, &quote.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return &quote, nil
+}
+
 func ValidateQuote(v *validator.Validator, quote *Quote) {
 	v.Check(quote.Quote != "", "quote", "must be provided")
 }
 
-func (m QuoteModel) GetQuotesByCharacterID(characterID int) ([]*Quote, error) {
+func (m QuoteModel) GetQuotesByCharacterID(ctx context.Context, characterID int) ([]*Quote, error) {
 	query := `
 		SELECT q.id, q.quote, q.created_at, q.updated_at
 		FROM quotes q
@@ -164,7 +189,10 @@ func (m QuoteModel) GetQuotesByCharacterID(characterID int) ([]*Quote, error) {
 		WHERE cq.character_id = $1
 		ORDER BY q.id`
 
-	rows, err := m.DB.Query(query, characterID)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, characterID)
 	if err != nil {
 		return nil, err
 	}
@@ -186,3 +214,8 @@ func (m QuoteModel) GetQuotesByCharacterID(characterID int) ([]*Quote, error) {
 
 	return quotes, nil
 }
+
+// Stamp returns the ID and update time of a quote, which identify a version of it.
+func (q *Quote) Stamp() (int, time.Time) {
+	return q.ID, q.UpdatedAt
+}
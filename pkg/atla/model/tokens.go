@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base32"
 	"log"
 	"time"
@@ -32,26 +31,27 @@ type (
 	// TokenModel struct wraps a sql.DB connection pool and allows us to work with the Token struct
 	// type and the tokens table in our database.
 	TokenModel struct {
-		DB       *sql.DB
+		DB       DBTX
 		InfoLog  *log.Logger
 		ErrorLog *log.Logger
+		Timeouts Timeouts
 	}
 )
 
 // New creates a new token and inserts the token record into the tokens table.
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 
 }
 
 // Insert inserts a new token record into the tokens table.
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `
 		INSERT INTO tokens (hash, user_id, expiry, scope)
 		VALUES ($1, $2, $3, $4)
@@ -59,7 +59,7 @@ func (m TokenModel) Insert(token *Token) error {
 
 	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
@@ -67,19 +67,36 @@ func (m TokenModel) Insert(token *Token) error {
 }
 
 // DeleteAllForUser deletes all tokens for a specific user and scope.
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
 		DELETE FROM tokens
 		WHERE scope = $1 AND user_id = $2
 		`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
 
+// DeleteExpired deletes the tokens of every scope which have expired, and returns how many.
+func (m TokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE expiry < NOW()
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	// Create a Token instance containing the user ID, expiry, and scope information.
 	// Notice that we add the provided ttl (time-to-live) duration parameter to the
@@ -38,9 +38,10 @@ func (u *User) IsAnonymous() bool {
 // UserModel struct wraps a sql.DB connection pool and allows us to work with the User struct type
 // and the users table in our database.
 type UserModel struct {
-	DB       *sql.DB
+	DB       DBTX
 	InfoLog  *log.Logger
 	ErrorLog *log.Logger
+	Timeouts Timeouts
 }
 
 // password tyep is a struct containing the plaintext and hashed version of a password for a User.
@@ -85,16 +86,16 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 // created_at, and version fields are all automatically generated by our database, so we use use
 // the RETURNING clause to read them into the User struct after the insert. Also, we check
 // if our table already contains the same email address and if so return ErrDuplicateEmail error.
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
-		INSERT INTO users (name, email, password_hash, activated)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO users (name, email, password_hash, activated, activated_at)
+		VALUES ($1, $2, $3, $4, CASE WHEN $4 THEN NOW() END)
 		RETURNING id, created_at, version
 		`
 
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	// If the table already contains a record with this email address, then when we try to
@@ -118,7 +119,7 @@ func (m UserModel) Insert(user *User) error {
 // GetByEmail retrieves the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this query will only return one record,
 // or none at all, upon which we return a ErrRecordNotFound error).
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
 		SELECT id, created_at, name, email, password_hash, activated, version
 		FROM users
@@ -127,7 +128,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -152,13 +153,64 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// GetAll returns all users, in the order they were created.
+func (m UserModel) GetAll(ctx context.Context) ([]*User, error) {
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		ORDER BY id
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			logError(m.ErrorLog, ctx, err)
+		}
+	}()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
 // Update updates the details for a specific user in the users table. Note, we check against the
 // version field to help prevent any race conditions during the request cycle. Also, we check
-// for a violation of the "user_email_key" constraint.
-func (m UserModel) Update(user *User) error {
+// for a violation of the "user_email_key" constraint. The first activation of the user is
+// recorded in activated_at, which a deactivation leaves alone.
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
+		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1,
+			activated_at = CASE WHEN $4 THEN COALESCE(activated_at, NOW()) ELSE activated_at END
 		WHERE id = $5 AND version = $6
 		RETURNING version
 		`
@@ -172,7 +224,7 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
@@ -190,8 +242,27 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
+// DeleteUnactivated deletes the users who registered before the given time and never activated
+// their account, along with their tokens. Users who were deactivated after being activated are
+// kept. It returns the number of users deleted.
+func (m UserModel) DeleteUnactivated(ctx context.Context, before time.Time) (int64, error) {
+	query := `
+		DELETE FROM users
+		WHERE activated = false AND activated_at IS NULL AND created_at < $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 // GetForToken retrieves a user record from the users table for an associated token and token scope.
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the SHA-256 hash for the plaintext token provided by the client.
 	// Note, that this will return a byte *array* with length 32, not a slice.
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
@@ -218,7 +289,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
 	defer cancel()
 
 	// Execute the query, scanning the return values into a User struct. If no matching record
@@ -0,0 +1,182 @@
+// Package schedule runs functions on cron-style schedules.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed cron expression. Its times are in UTC.
+type Cron struct {
+	spec   string
+	minute uint64 // bit n is set if minute n matches
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// anyDay is set when the day of the month or the day of the week is *, in which case a day
+	// has to match both fields. Otherwise it has to match either, as in cron.
+	anyDay bool
+}
+
+// shortcuts are the named schedules Parse accepts in place of the five fields.
+var shortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// field describes one of the five fields of a cron expression.
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Parse parses a cron expression of five fields: minute, hour, day of the month, month and day
+// of the week, where Sunday is 0 or 7. Each field is *, a number, a range such as 1-5, or a
+// comma-separated list of those, and * and ranges may have a step such as */15. The @hourly,
+// @daily, @midnight, @weekly, @monthly, @yearly and @annually shortcuts are accepted too.
+// Expressions which never match, such as February 30, are rejected.
+func Parse(spec string) (Cron, error) {
+	c := Cron{spec: spec}
+
+	expr := strings.TrimSpace(spec)
+	if s, ok := shortcuts[expr]; ok {
+		expr = s
+	}
+
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return c, fmt.Errorf("cron expression %q must have 5 fields", spec)
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, f := range fields {
+		set, err := parseField(parts[i], f)
+		if err != nil {
+			return c, fmt.Errorf("cron expression %q: %w", spec, err)
+		}
+		sets[i] = set
+	}
+
+	c.minute, c.hour, c.dom, c.month, c.dow = sets[0], sets[1], sets[2], sets[3], sets[4]
+	// Sunday can be written 0 or 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.anyDay = strings.HasPrefix(parts[2], "*") || strings.HasPrefix(parts[4], "*")
+
+	if c.Next(time.Now()).IsZero() {
+		return c, fmt.Errorf("cron expression %q never matches", spec)
+	}
+
+	return c, nil
+}
+
+func parseField(s string, f field) (uint64, error) {
+	var set uint64
+
+	for _, item := range strings.Split(s, ",") {
+		rng, step := item, 1
+		if i := strings.IndexByte(item, '/'); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %s %q", f.name, item)
+			}
+			rng, step = item[:i], n
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			a, b, _ := strings.Cut(rng, "-")
+			var err error
+			if lo, err = parseValue(a, f); err != nil {
+				return 0, err
+			}
+			if hi, err = parseValue(b, f); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range in %s %q", f.name, item)
+			}
+		default:
+			v, err := parseValue(rng, f)
+			if err != nil {
+				return 0, err
+			}
+			lo, hi = v, v
+			// A single value with a step, such as 5/10, runs from the value to the maximum.
+			if step > 1 {
+				hi = f.max
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+
+	return set, nil
+}
+
+func parseValue(s string, f field) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s must be a number between %d and %d, got %q", f.name, f.min, f.max, s)
+	}
+	return v, nil
+}
+
+// String returns the expression c was parsed from.
+func (c Cron) String() string {
+	return c.spec
+}
+
+// Next returns the first time after t that matches c, or the zero time if there is none in the
+// next five years, for example for February 30.
+func (c Cron) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+
+	for t.Before(end) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+func (c Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,99 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: "* * * * *"},
+		{spec: " 0 0 * * * "},
+		{spec: "@daily"},
+		{spec: "@annually"},
+		{spec: "0,30 8-18/2 1-15 1,6,12 1-5"},
+		{spec: "0 0 29 2 *"},
+		{spec: "0 0 30 2 1"}, // never February 30, but every Monday of February
+		{spec: "0 0 * * 7"},
+
+		{spec: "", wantErr: true},
+		{spec: "* * * *", wantErr: true},
+		{spec: "* * * * * *", wantErr: true},
+		{spec: "@every 5m", wantErr: true},
+		{spec: "60 * * * *", wantErr: true},
+		{spec: "* 24 * * *", wantErr: true},
+		{spec: "* * 0 * *", wantErr: true},
+		{spec: "* * * 13 *", wantErr: true},
+		{spec: "* * * * 8", wantErr: true},
+		{spec: "5-1 * * * *", wantErr: true},
+		{spec: "*/0 * * * *", wantErr: true},
+		{spec: "*/x * * * *", wantErr: true},
+		{spec: "a * * * *", wantErr: true},
+		{spec: "1,,2 * * * *", wantErr: true},
+		{spec: "0 0 30 2 *", wantErr: true},
+		{spec: "0 0 31 4,6,9,11 *", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			c, err := Parse(tt.spec)
+			switch {
+			case tt.wantErr && err == nil:
+				t.Fatal("got no error, want one")
+			case !tt.wantErr && err != nil:
+				t.Fatal(err)
+			case !tt.wantErr && c.String() != tt.spec:
+				t.Errorf("String() = %q, want %q", c.String(), tt.spec)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"step", "*/15 * * * *", date(2024, 3, 10, 10, 7).Add(30 * time.Second), date(2024, 3, 10, 10, 15)},
+		{"strictly after", "*/15 * * * *", date(2024, 3, 10, 10, 15), date(2024, 3, 10, 10, 30)},
+		{"step in a range", "10-30/10 8 * * *", date(2024, 6, 1, 8, 15), date(2024, 6, 1, 8, 20)},
+		{"step in a range, next day", "10-30/10 8 * * *", date(2024, 6, 1, 8, 30), date(2024, 6, 2, 8, 10)},
+		{"step from a value", "5/20 * * * *", date(2024, 6, 1, 10, 26), date(2024, 6, 1, 10, 45)},
+		{"hour rollover", "0 * * * *", date(2024, 6, 1, 23, 30), date(2024, 6, 2, 0, 0)},
+		{"year rollover", "0 0 * * *", date(2024, 12, 31, 23, 59), date(2025, 1, 1, 0, 0)},
+		{"month rollover", "@monthly", date(2024, 1, 31, 12, 0), date(2024, 2, 1, 0, 0)},
+		{"month without the day", "0 0 31 * *", date(2024, 4, 15, 0, 0), date(2024, 5, 31, 0, 0)},
+		{"month of another year", "30 23 * 2 *", date(2024, 2, 29, 23, 45), date(2025, 2, 1, 23, 30)},
+		{"leap day", "0 0 29 2 *", date(2025, 3, 1, 0, 0), date(2028, 2, 29, 0, 0)},
+		// 1 June 2024 is a Saturday.
+		{"day of month or week, by month", "0 12 1 * 1", date(2024, 5, 28, 13, 0), date(2024, 6, 1, 12, 0)},
+		{"day of month or week, by week", "0 12 1 * 1", date(2024, 6, 1, 13, 0), date(2024, 6, 3, 12, 0)},
+		{"day of week only", "0 0 * * 1", date(2024, 6, 1, 0, 0), date(2024, 6, 3, 0, 0)},
+		{"day of month with a * step and week", "0 0 */10 * 1", date(2024, 6, 1, 0, 0), date(2024, 7, 1, 0, 0)},
+		{"7 is Sunday", "0 9 * * 7", date(2024, 6, 1, 0, 0), date(2024, 6, 2, 9, 0)},
+		{"range to 7", "0 9 * * 5-7", date(2024, 6, 1, 10, 0), date(2024, 6, 2, 9, 0)},
+		{"0 is Sunday", "0 9 * * 0", date(2024, 6, 2, 10, 0), date(2024, 6, 9, 9, 0)},
+		{"UTC", "0 1 * * *", time.Date(2024, 6, 1, 5, 30, 0, 0, time.FixedZone("UTC+5", 5*60*60)), date(2024, 6, 1, 1, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/justverena/ATLA/pkg/jsonlog"
+)
+
+// Scheduler calls functions at the times of their cron expressions. Runs missed while the
+// scheduler wasn't running aren't caught up.
+type Scheduler struct {
+	Logger *jsonlog.Logger
+
+	mu      sync.Mutex
+	entries []*entry
+}
+
+type entry struct {
+	name     string
+	schedule Cron
+	fn       func(ctx context.Context) error
+	next     time.Time
+	last     time.Time
+	lastErr  error
+}
+
+// Entry describes a scheduled function.
+type Entry struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	NextRun  time.Time `json:"next_run"`
+	// LastRun is when the function was last called by this process, zero if it hasn't been.
+	LastRun   time.Time `json:"last_run"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// New returns a scheduler without entries.
+func New(logger *jsonlog.Logger) *Scheduler {
+	return &Scheduler{Logger: logger}
+}
+
+// Add calls fn on schedule once Run has been called. It panics if name is already scheduled.
+func (s *Scheduler) Add(name string, schedule Cron, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.entries {
+		if e.name == name {
+			panic("schedule: " + name + " added twice")
+		}
+	}
+	s.entries = append(s.entries, &entry{name: name, schedule: schedule, fn: fn})
+}
+
+// Entries returns the scheduled functions, by name.
+func (s *Scheduler) Entries() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entry := Entry{
+			Name:     e.name,
+			Schedule: e.schedule.String(),
+			NextRun:  e.next,
+			LastRun:  e.last,
+		}
+		if entry.NextRun.IsZero() {
+			entry.NextRun = e.schedule.Next(time.Now())
+		}
+		if e.lastErr != nil {
+			entry.LastError = e.lastErr.Error()
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Run calls the functions when they are due, one at a time, until ctx is cancelled. A function
+// which is still running when the next one is due delays it.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	now := time.Now()
+	for _, e := range s.entries {
+		e.next = e.schedule.Next(now)
+	}
+	s.mu.Unlock()
+
+	for {
+		due, wait := s.due(time.Now())
+		for _, e := range due {
+			s.call(ctx, e)
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// due returns the entries whose time has come, or how long to wait for the next one.
+func (s *Scheduler) due(now time.Time) ([]*entry, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*entry
+	wait := time.Hour
+	for _, e := range s.entries {
+		if e.next.IsZero() {
+			continue
+		}
+		if !e.next.After(now) {
+			due = append(due, e)
+		} else if d := e.next.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	return due, wait
+}
+
+func (s *Scheduler) call(ctx context.Context, e *entry) {
+	started := time.Now()
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return e.fn(ctx)
+	}()
+
+	s.mu.Lock()
+	e.last = started
+	e.lastErr = err
+	e.next = e.schedule.Next(time.Now())
+	s.mu.Unlock()
+
+	if err != nil {
+		s.Logger.PrintError(err, map[string]string{
+			"schedule": e.name,
+		})
+	}
+}
@@ -1,6 +1,10 @@
 package validator
 
-import "regexp"
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
 
 var (
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
@@ -30,6 +34,17 @@ func (v *Validator) Check(ok bool, key, message string) {
 	}
 }
 
+// Summary lists the errors as "field message" pairs, sorted and separated by commas, for the
+// command line tools which report them as a single error.
+func (v *Validator) Summary() string {
+	problems := make([]string, 0, len(v.Errors))
+	for field, message := range v.Errors {
+		problems = append(problems, field+" "+message)
+	}
+	sort.Strings(problems)
+	return strings.Join(problems, ", ")
+}
+
 func In(value string, list ...string) bool {
 	for i := range list {
 		if value == list[i] {
@@ -2,10 +2,13 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,27 +33,49 @@ func (l Level) String() string {
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
+// ParseLevel returns the level named s, one of info, error, fatal and off, in any case.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelInfo; l <= LevelOff; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
 // Logger is the custom logger. It holds the output destination that the log entries will be
 // written to, the minimum severity level that log entries will be written for, and a mutex
-// for coordination the writes.
+// for coordination the writes. The minimum level is atomic, so that it can be changed while
+// the logger is in use.
 type Logger struct {
 	out      io.Writer
-	minLevel Level
+	minLevel atomic.Int32
 	mu       sync.Mutex
 }
 
 // NewLogger returns a new Logger instance which writes log entries at or above a minimum severity
 // level to a specific output destination.
 func NewLogger(out io.Writer, minLevel Level) *Logger {
-	return &Logger{
-		out:      out,
-		minLevel: minLevel,
-	}
+	l := &Logger{out: out}
+	l.SetLevel(minLevel)
+	return l
+}
+
+// SetLevel changes the minimum severity level of the entries that are written.
+func (l *Logger) SetLevel(minLevel Level) {
+	l.minLevel.Store(int32(minLevel))
+}
+
+// Level returns the minimum severity level of the entries that are written.
+func (l *Logger) Level() Level {
+	return Level(l.minLevel.Load())
 }
 
 // PrintInfo is a helper that writes Info level log entries.
@@ -73,7 +98,7 @@ func (l *Logger) PrintFatal(err error, properties map[string]string) {
 func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
 	// If the severity level of the log entry is below the minimum severity for the logger
 	// then return with no further action
-	if level < l.minLevel {
+	if level < l.Level() {
 		return 0, nil
 	}
 